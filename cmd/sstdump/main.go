@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring/v2"
+	"sampleGoProject/lsm"
+)
+
+type posting map[uint32][]uint32
+
+type version struct {
+	level int
+	table string
+	entry lsm.Entry
+}
+
+func main() {
+	keys := flag.Bool("keys", false, "dump every key")
+	values := flag.String("values", "", "dump values decoded as auto, raw, roaring or positional")
+	inspect := flag.Bool("inspect", false, "treat the argument as an LSM directory and print its level layout")
+	history := flag.Bool("history", false, "with -inspect, print the version history of every key")
+	prefix := flag.String("prefix", "", "only dump keys with this prefix")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sstdump [-keys] [-values=auto|raw|roaring|positional] [-prefix p] file.sst...")
+		fmt.Fprintln(os.Stderr, "       sstdump -inspect [-history] [-values=...] [-prefix p] dir")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *values {
+	case "", "auto", "raw", "roaring", "positional":
+	default:
+		fmt.Fprintf(os.Stderr, "sstdump: unknown value format %q\n", *values)
+		os.Exit(2)
+	}
+
+	var err error
+	if *inspect {
+		err = inspectDir(flag.Arg(0), *history, *values, *prefix)
+	} else {
+		for _, path := range flag.Args() {
+			if err = dumpTable(path, *keys || *values != "", *values, *prefix); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sstdump:", err)
+		os.Exit(1)
+	}
+}
+
+func dumpTable(path string, keys bool, values, prefix string) error {
+	t, err := lsm.OpenSSTable(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer t.Close()
+
+	info := t.Info()
+	fmt.Printf("%s\n", info.Path)
+	fmt.Printf("  format:    %d\n", info.Format)
+	fmt.Printf("  size:      %d bytes\n", info.Size)
+	fmt.Printf("  keys:      %d\n", info.KeyCount)
+	fmt.Printf("  blocks:    %d\n", info.Blocks)
+	fmt.Printf("  key range: [%q, %q]\n", info.MinKey, info.MaxKey)
+	fmt.Printf("  bloom:     %d bits, %d hashes\n", info.BloomBits, info.BloomHashes)
+	if len(info.ValueLogs) > 0 {
+		fmt.Printf("  vlogs:     %s\n", strings.Join(info.ValueLogs, " "))
+	}
+	if !keys {
+		return nil
+	}
+	return t.Scan(func(e lsm.Entry) error {
+		if strings.HasPrefix(e.Key, prefix) {
+			resolveValue(t, &e, values)
+			fmt.Printf("  %q %s\n", e.Key, formatEntry(e, values))
+		}
+		return nil
+	})
+}
+
+func inspectDir(dir string, history bool, values, prefix string) error {
+	levels, err := lsm.OpenTables(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, tables := range levels {
+			for _, t := range tables {
+				_ = t.Close()
+			}
+		}
+	}()
+
+	for level, tables := range levels {
+		var size uint64
+		for _, t := range tables {
+			size += t.Info().Size
+		}
+		fmt.Printf("L%d: %d tables, %d bytes\n", level, len(tables), size)
+		for _, t := range tables {
+			info := t.Info()
+			fmt.Printf("  %s keys=%d size=%d range=[%q, %q]", filepath.Base(info.Path), info.KeyCount, info.Size, info.MinKey, info.MaxKey)
+			if info.Ingested {
+				fmt.Printf(" ingested seq=%d", info.GlobalSeq)
+			}
+			fmt.Println()
+		}
+	}
+	if !history {
+		return nil
+	}
+
+	versions := make(map[string][]version)
+	for level, tables := range levels {
+		for _, t := range tables {
+			name := filepath.Base(t.Info().Path)
+			err := t.Scan(func(e lsm.Entry) error {
+				if strings.HasPrefix(e.Key, prefix) {
+					resolveValue(t, &e, values)
+					versions[e.Key] = append(versions[e.Key], version{level: level, table: name, entry: e})
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	keys := make([]string, 0, len(versions))
+	for k := range versions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Println()
+	for _, k := range keys {
+		fmt.Printf("%q\n", k)
+		vs := versions[k]
+		sort.SliceStable(vs, func(i, j int) bool { return vs[i].entry.Sequence > vs[j].entry.Sequence })
+		for _, v := range vs {
+			fmt.Printf("  L%d %s %s\n", v.level, v.table, formatEntry(v.entry, values))
+		}
+	}
+	return nil
+}
+
+func resolveValue(t *lsm.SSTable, e *lsm.Entry, values string) {
+	if values == "" || e.ValueLog == "" {
+		return
+	}
+	if err := t.ResolveValue(e); err != nil {
+		fmt.Fprintf(os.Stderr, "sstdump: %s@%d: %v\n", e.ValueLog, e.ValueAt, err)
+	}
+}
+
+func formatEntry(e lsm.Entry, values string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "seq=%d %s", e.Sequence, e.Kind)
+	if !e.ExpiresAt.IsZero() {
+		fmt.Fprintf(&b, " expires=%s", e.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+	if e.ValueLog != "" && e.Value == nil {
+		fmt.Fprintf(&b, " value=%s@%d", e.ValueLog, e.ValueAt)
+	}
+	if e.Value != nil && values != "" {
+		b.WriteString(" ")
+		b.WriteString(formatValue([]byte(*e.Value), values))
+	}
+	return b.String()
+}
+
+func formatValue(raw []byte, format string) string {
+	switch format {
+	case "raw":
+		return strconv.Quote(string(raw))
+	case "roaring":
+		if s, ok := formatRoaring(raw); ok {
+			return s
+		}
+		return "<invalid roaring bitmap> " + strconv.Quote(string(raw))
+	case "positional":
+		if s, ok := formatPositional(raw); ok {
+			return s
+		}
+		return "<invalid positional posting> " + strconv.Quote(string(raw))
+	}
+	if s, ok := formatPositional(raw); ok {
+		return s
+	}
+	if s, ok := formatRoaring(raw); ok {
+		return s
+	}
+	return strconv.Quote(string(raw))
+}
+
+func formatRoaring(raw []byte) (s string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			s, ok = "", false
+		}
+	}()
+	bm := roaring.New()
+	if err := bm.UnmarshalBinary(raw); err != nil || bm.GetSerializedSizeInBytes() != uint64(len(raw)) {
+		return "", false
+	}
+	return "roaring" + bm.String(), true
+}
+
+func formatPositional(raw []byte) (string, bool) {
+	var p posting
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&p); err != nil {
+		return "", false
+	}
+	docs := make([]uint32, 0, len(p))
+	for doc := range p {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i] < docs[j] })
+	var b strings.Builder
+	b.WriteString("positional{")
+	for i, doc := range docs {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%d:%v", doc, p[doc])
+	}
+	b.WriteString("}")
+	return b.String(), true
+}
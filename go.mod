@@ -11,6 +11,7 @@ require (
 	github.com/bbalet/stopwords v1.0.0 // indirect
 	github.com/bits-and-blooms/bitset v1.24.2 // indirect
 	github.com/emirpasic/gods v1.18.1 // indirect
+	github.com/golang/snappy v1.0.0 // indirect
 	github.com/kljensen/snowball v0.10.0 // indirect
 	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
@@ -1,12 +1,24 @@
 package invertedindex
 
 import (
+	"errors"
 	"reflect"
 	"testing"
+
+	"sampleGoProject/lsm"
 )
 
+func newTestIndex(t *testing.T, maxSize int) *InvertedIndex {
+	t.Helper()
+	idx, err := NewInvertedIndexWithLSM(maxSize, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewInvertedIndexWithLSM: %v", err)
+	}
+	return idx
+}
+
 func TestInvertedIndex(t *testing.T) {
-	idx := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx := newTestIndex(t, 1024)
 	idx.AddDocument(1, "running fast with maps")
 	idx.AddDocument(2, "run bloom filter")
 	idx.AddDocument(3, "roaring bitmap index bloom")
@@ -29,7 +41,7 @@ func TestInvertedIndex(t *testing.T) {
 		}
 	}
 
-	small := NewInvertedIndexWithLSM(2, t.TempDir())
+	small := newTestIndex(t, 2)
 	small.AddDocument(1, "running map")
 	small.AddDocument(2, "run bloom")
 	small.AddDocument(3, "map bloom")
@@ -44,3 +56,42 @@ func TestInvertedIndex(t *testing.T) {
 		t.Fatalf("after Compact = %v, want [2]", got)
 	}
 }
+
+func TestAddDocumentReportsWriteErrors(t *testing.T) {
+	idx := newTestIndex(t, 1024)
+	if err := idx.AddDocument(1, "running map"); err != nil {
+		t.Fatalf("AddDocument: %v", err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.AddDocument(2, "run bloom"); !errors.Is(err, lsm.ErrClosed) {
+		t.Fatalf("AddDocument after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestDamagedPostingIsReported(t *testing.T) {
+	idx := newTestIndex(t, 1024)
+	defer idx.Close()
+	garbage := "not a bitmap"
+	if err := idx.tree.Put("run", &garbage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Search("running"); err == nil {
+		t.Fatal("Search over a damaged posting succeeded")
+	}
+	if err := idx.AddDocument(1, "running"); err == nil {
+		t.Fatal("AddDocument over a damaged posting succeeded")
+	}
+}
+
+func TestSearchWithoutTree(t *testing.T) {
+	var idx InvertedIndex
+	got, err := idx.Search("run AND map")
+	if err != nil || got != nil {
+		t.Fatalf("Search on empty index = %v, %v; want no results", got, err)
+	}
+	if _, err := idx.Search("run AND"); err == nil {
+		t.Fatal("expected a parse error without a tree")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"unicode"
 
 	"github.com/RoaringBitmap/roaring/v2"
+	"sampleGoProject/lsm"
 )
 
 func (idx *InvertedIndex) Search(query string) ([]int, error) {
@@ -13,6 +14,8 @@ func (idx *InvertedIndex) Search(query string) ([]int, error) {
 	if len(tokens) == 0 {
 		return nil, fmt.Errorf("empty query")
 	}
+	snap, release := idx.snapshot()
+	defer release()
 
 	values := make([]*roaring.Bitmap, 0, len(tokens))
 	ops := make([]string, 0, len(tokens))
@@ -59,7 +62,11 @@ func (idx *InvertedIndex) Search(query string) ([]int, error) {
 			if !expectValue {
 				return nil, fmt.Errorf("unexpected token %q", token)
 			}
-			values = append(values, idx.termBitmap(token))
+			bm, err := idx.termBitmap(snap, token)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, bm)
 			expectValue = false
 		}
 	}
@@ -84,12 +91,12 @@ func (idx *InvertedIndex) Search(query string) ([]int, error) {
 	return bitmapToIntSlice(values[0]), nil
 }
 
-func (idx *InvertedIndex) termBitmap(term string) *roaring.Bitmap {
+func (idx *InvertedIndex) termBitmap(snap lsm.Reader, term string) (*roaring.Bitmap, error) {
 	normalized := idx.normalizeWord(term)
 	if normalized == "" {
-		return roaring.New()
+		return roaring.New(), nil
 	}
-	return idx.loadPosting(normalized)
+	return idx.loadPosting(snap, normalized)
 }
 
 func applyOperator(op string, values *[]*roaring.Bitmap) error {
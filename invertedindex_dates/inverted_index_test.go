@@ -6,6 +6,15 @@ import (
 	"time"
 )
 
+func newTestIndex(t *testing.T, maxSize int) *InvertedIndex {
+	t.Helper()
+	idx, err := NewInvertedIndexWithLSM(maxSize, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewInvertedIndexWithLSM: %v", err)
+	}
+	return idx
+}
+
 func d(y int, m time.Month, day int) time.Time {
 	return time.Date(y, m, day, 12, 0, 0, 0, time.UTC)
 }
@@ -13,7 +22,7 @@ func d(y int, m time.Month, day int) time.Time {
 func ptr(t time.Time) *time.Time { return &t }
 
 func TestInvertedIndexDates(t *testing.T) {
-	idx := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx := newTestIndex(t, 1024)
 	idx.AddDocument(1, "running fast with maps", d(2020, 1, 10), nil)
 	idx.AddDocument(2, "run bloom filter", d(2021, 6, 15), nil)
 	idx.AddDocument(3, "roaring bitmap index bloom", d(2020, 3, 1), nil)
@@ -36,7 +45,7 @@ func TestInvertedIndexDates(t *testing.T) {
 		}
 	}
 
-	idx2 := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx2 := newTestIndex(t, 1024)
 	idx2.AddDocument(1, "a", d(2022, 1, 1), nil)
 	idx2.AddDocument(2, "b", d(2023, 1, 1), nil)
 	got := idx2.SearchDateInRange(d(2022, 1, 1), d(2022, 12, 31))
@@ -44,7 +53,7 @@ func TestInvertedIndexDates(t *testing.T) {
 		t.Fatalf("SearchDateInRange = %v, want [1]", got)
 	}
 
-	idx3 := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx3 := newTestIndex(t, 1024)
 	idx3.AddDocument(1, "alpha", d(2020, 1, 1), ptr(d(2020, 6, 30)))
 	idx3.AddDocument(2, "beta", d(2020, 5, 1), nil)
 	idx3.AddDocument(3, "gamma", d(2020, 3, 1), ptr(d(2020, 3, 31)))
@@ -55,7 +64,7 @@ func TestInvertedIndexDates(t *testing.T) {
 		t.Fatalf("SearchValidInRange march = %v, want [1 3]", g)
 	}
 
-	idx4 := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx4 := newTestIndex(t, 1024)
 	idx4.AddDocument(1, "a", d(2019, 1, 1), ptr(d(2020, 1, 1)))
 	idx4.AddDocument(2, "b", d(2020, 6, 1), nil)
 	idx4.AddDocument(3, "c", d(2021, 1, 1), nil)
@@ -63,7 +72,7 @@ func TestInvertedIndexDates(t *testing.T) {
 		t.Fatalf("SearchAppearedInRange = %v, want [2]", g)
 	}
 
-	idx5 := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx5 := newTestIndex(t, 1024)
 	idx5.AddDocument(1, "cat dog", d(2020, 1, 1), ptr(d(2020, 12, 31)))
 	idx5.AddDocument(2, "cat dog", d(2021, 1, 1), ptr(d(2021, 6, 30)))
 	idx5.AddDocument(3, "dog fish", d(2020, 6, 1), nil)
@@ -82,7 +91,7 @@ func TestInvertedIndexDates(t *testing.T) {
 		t.Fatalf("APPEARED query = %v, want [2]", got)
 	}
 
-	idx6 := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx6 := newTestIndex(t, 1024)
 	idx6.AddDocument(1, "running fast with maps", d(2000, 1, 1), nil)
 	idx6.AddDocument(2, "run bloom filter", d(2000, 1, 1), nil)
 	idx6.AddDocument(3, "roaring bitmap index bloom", d(2000, 1, 1), nil)
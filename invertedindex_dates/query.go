@@ -7,6 +7,7 @@ import (
 	"unicode"
 
 	"github.com/RoaringBitmap/roaring/v2"
+	"sampleGoProject/lsm"
 )
 
 func (idx *InvertedIndex) Search(query string) ([]int, error) {
@@ -17,6 +18,8 @@ func (idx *InvertedIndex) Search(query string) ([]int, error) {
 	if len(tokens) == 0 {
 		return nil, fmt.Errorf("empty query")
 	}
+	snap, release := idx.snapshot()
+	defer release()
 
 	values := make([]*roaring.Bitmap, 0, len(tokens))
 	ops := make([]string, 0, len(tokens))
@@ -73,7 +76,11 @@ func (idx *InvertedIndex) Search(query string) ([]int, error) {
 			if !expectValue {
 				return nil, fmt.Errorf("unexpected token %q", tok)
 			}
-			values = append(values, idx.termBitmap(tok))
+			bm, err := idx.termBitmap(snap, tok)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, bm)
 			expectValue = false
 		}
 	}
@@ -134,12 +141,12 @@ func (idx *InvertedIndex) SearchAppearedInRange(from, to time.Time) []int {
 	return bitmapToIntSlice(idx.bitmapAppearedInRange(from, to))
 }
 
-func (idx *InvertedIndex) termBitmap(term string) *roaring.Bitmap {
+func (idx *InvertedIndex) termBitmap(snap lsm.Reader, term string) (*roaring.Bitmap, error) {
 	normalized := idx.normalizeWord(term)
 	if normalized == "" {
-		return roaring.New()
+		return roaring.New(), nil
 	}
-	return idx.loadPosting(normalized)
+	return idx.loadPosting(snap, normalized)
 }
 
 func applyOperator(op string, values *[]*roaring.Bitmap) error {
@@ -17,31 +17,58 @@ type InvertedIndex struct {
 	k      int
 }
 
-func NewInvertedIndex() *InvertedIndex {
-	return NewInvertedIndexWithLSM(1024, "invertedindex_lsmdata")
+func NewInvertedIndex() (*InvertedIndex, error) {
+	return NewInvertedIndexWithLSM(4<<20, "invertedindex_lsmdata")
 }
 
-func NewInvertedIndexWithLSM(maxSize int, dir string) *InvertedIndex {
+func NewInvertedIndexWithLSM(maxSize int, dir string) (*InvertedIndex, error) {
+	opts := lsm.DefaultOptions()
+	opts.MaxSize = maxSize
+	tree, err := lsm.Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
 	return &InvertedIndex{
-		tree:   lsm.InitWithDir(maxSize, dir),
+		tree:   tree,
 		terms:  make(map[string]struct{}),
 		kgrams: make(map[string]map[string]struct{}),
 		k:      3,
-	}
+	}, nil
 }
 
-func (idx *InvertedIndex) AddDocument(docID int, text string) {
+func (idx *InvertedIndex) AddDocument(docID int, text string) error {
 	if docID < 0 || docID > math.MaxUint32 {
-		return
+		return nil
 	}
 	id := uint32(docID)
 
+	postings := make(map[string]*roaring.Bitmap)
 	for _, token := range idx.normalizeAndTokenize(text) {
-		idx.addTerm(token)
-		bm := idx.loadPosting(token)
+		bm, ok := postings[token]
+		if !ok {
+			var err error
+			bm, err = idx.loadPosting(idx.tree, token)
+			if err != nil {
+				return err
+			}
+			postings[token] = bm
+		}
 		bm.Add(id)
-		idx.storePosting(token, bm)
 	}
+
+	batch := lsm.NewWriteBatch()
+	for term, bm := range postings {
+		idx.storePosting(batch, term, bm)
+	}
+	if idx.tree != nil {
+		if err := idx.tree.Write(batch); err != nil {
+			return err
+		}
+	}
+	for term := range postings {
+		idx.addTerm(term)
+	}
+	return nil
 }
 
 func (idx *InvertedIndex) Compact() error {
@@ -51,6 +78,21 @@ func (idx *InvertedIndex) Compact() error {
 	return idx.tree.Compact()
 }
 
+func (idx *InvertedIndex) Close() error {
+	if idx.tree == nil {
+		return nil
+	}
+	return idx.tree.Close()
+}
+
+func (idx *InvertedIndex) snapshot() (lsm.Reader, func()) {
+	if idx.tree == nil {
+		return nil, func() {}
+	}
+	snap := idx.tree.Snapshot()
+	return snap, snap.Release
+}
+
 func (idx *InvertedIndex) normalizeAndTokenize(text string) []string {
 	if text == "" {
 		return nil
@@ -81,22 +123,22 @@ func (idx *InvertedIndex) normalizeWord(word string) string {
 	return tokens[0]
 }
 
-func (idx *InvertedIndex) loadPosting(term string) *roaring.Bitmap {
+func (idx *InvertedIndex) loadPosting(r lsm.Reader, term string) (*roaring.Bitmap, error) {
 	if idx.tree == nil {
-		return roaring.New()
+		return roaring.New(), nil
 	}
-	raw := idx.tree.Get(term)
-	if raw == nil {
-		return roaring.New()
+	raw, err := r.GetErr(term)
+	if err != nil || raw == nil {
+		return roaring.New(), err
 	}
 	bm := roaring.New()
 	if _, err := bm.FromBuffer([]byte(*raw)); err != nil {
-		return roaring.New()
+		return nil, err
 	}
-	return bm
+	return bm, nil
 }
 
-func (idx *InvertedIndex) storePosting(term string, bm *roaring.Bitmap) {
+func (idx *InvertedIndex) storePosting(batch *lsm.WriteBatch, term string, bm *roaring.Bitmap) {
 	if idx.tree == nil || bm == nil {
 		return
 	}
@@ -105,7 +147,7 @@ func (idx *InvertedIndex) storePosting(term string, bm *roaring.Bitmap) {
 		return
 	}
 	s := string(data)
-	idx.tree.Put(term, &s)
+	batch.Put(term, &s)
 }
 
 func (idx *InvertedIndex) addTerm(term string) {
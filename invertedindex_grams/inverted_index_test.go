@@ -5,8 +5,17 @@ import (
 	"testing"
 )
 
+func newTestIndex(t *testing.T, maxSize int) *InvertedIndex {
+	t.Helper()
+	idx, err := NewInvertedIndexWithLSM(maxSize, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewInvertedIndexWithLSM: %v", err)
+	}
+	return idx
+}
+
 func TestInvertedIndexGrams(t *testing.T) {
-	idx := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx := newTestIndex(t, 1024)
 	idx.AddDocument(1, "running fast with maps")
 	idx.AddDocument(2, "run bloom filter")
 	idx.AddDocument(3, "roaring bitmap index bloom")
@@ -37,7 +46,7 @@ func TestInvertedIndexGrams(t *testing.T) {
 		t.Fatalf("SearchPrefix(ru) = %v, want [1 2]", got)
 	}
 
-	widx := NewInvertedIndexWithLSM(1024, t.TempDir())
+	widx := newTestIndex(t, 1024)
 	widx.AddDocument(1, "running fast")
 	widx.AddDocument(2, "runner slow")
 	widx.AddDocument(3, "bloom bitmap")
@@ -56,7 +65,7 @@ func TestInvertedIndexGrams(t *testing.T) {
 		t.Fatalf("SearchWildcard(*oom) = %v, want [3]", got)
 	}
 
-	small := NewInvertedIndexWithLSM(2, t.TempDir())
+	small := newTestIndex(t, 2)
 	small.AddDocument(1, "running map")
 	small.AddDocument(2, "run bloom")
 	small.AddDocument(3, "map bloom")
@@ -71,3 +80,16 @@ func TestInvertedIndexGrams(t *testing.T) {
 		t.Fatalf("after Compact = %v, want [2]", got)
 	}
 }
+
+func TestFailedAddDocumentLeavesDictionaries(t *testing.T) {
+	idx := newTestIndex(t, 1024)
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.AddDocument(1, "running map"); err == nil {
+		t.Fatal("AddDocument after Close succeeded")
+	}
+	if len(idx.terms) != 0 || len(idx.kgrams) != 0 {
+		t.Fatalf("failed AddDocument left terms %v and k-grams %v", idx.terms, idx.kgrams)
+	}
+}
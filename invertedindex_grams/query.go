@@ -8,6 +8,7 @@ import (
 	"unicode"
 
 	"github.com/RoaringBitmap/roaring/v2"
+	"sampleGoProject/lsm"
 )
 
 func (idx *InvertedIndex) Search(query string) ([]int, error) {
@@ -15,6 +16,8 @@ func (idx *InvertedIndex) Search(query string) ([]int, error) {
 	if len(tokens) == 0 {
 		return nil, fmt.Errorf("empty query")
 	}
+	snap, release := idx.snapshot()
+	defer release()
 
 	values := make([]*roaring.Bitmap, 0, len(tokens))
 	ops := make([]string, 0, len(tokens))
@@ -61,7 +64,11 @@ func (idx *InvertedIndex) Search(query string) ([]int, error) {
 			if !expectValue {
 				return nil, fmt.Errorf("unexpected token %q", token)
 			}
-			values = append(values, idx.termBitmap(token))
+			bm, err := idx.termBitmap(snap, token)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, bm)
 			expectValue = false
 		}
 	}
@@ -96,12 +103,19 @@ func (idx *InvertedIndex) SearchPrefix(prefix string) ([]int, error) {
 	if len(candidates) == 0 {
 		return nil, nil
 	}
+	snap, release := idx.snapshot()
+	defer release()
 
 	bm := roaring.New()
 	for _, term := range candidates {
-		if strings.HasPrefix(term, prefix) {
-			bm.Or(idx.loadPosting(term))
+		if !strings.HasPrefix(term, prefix) {
+			continue
 		}
+		p, err := idx.loadPosting(snap, term)
+		if err != nil {
+			return nil, err
+		}
+		bm.Or(p)
 	}
 	return bitmapToIntSlice(bm), nil
 }
@@ -111,8 +125,15 @@ func (idx *InvertedIndex) SearchWildcard(pattern string) ([]int, error) {
 	if pattern == "" {
 		return nil, fmt.Errorf("empty wildcard")
 	}
+	snap, release := idx.snapshot()
+	defer release()
+
 	if !strings.Contains(pattern, "*") {
-		return bitmapToIntSlice(idx.loadPosting(pattern)), nil
+		bm, err := idx.loadPosting(snap, pattern)
+		if err != nil {
+			return nil, err
+		}
+		return bitmapToIntSlice(bm), nil
 	}
 
 	candidates := idx.kgramIntersectFromRequired(patternKgrams(pattern, idx.k))
@@ -122,19 +143,24 @@ func (idx *InvertedIndex) SearchWildcard(pattern string) ([]int, error) {
 
 	bm := roaring.New()
 	for _, term := range candidates {
-		if wildcardMatch(pattern, term) {
-			bm.Or(idx.loadPosting(term))
+		if !wildcardMatch(pattern, term) {
+			continue
+		}
+		p, err := idx.loadPosting(snap, term)
+		if err != nil {
+			return nil, err
 		}
+		bm.Or(p)
 	}
 	return bitmapToIntSlice(bm), nil
 }
 
-func (idx *InvertedIndex) termBitmap(term string) *roaring.Bitmap {
+func (idx *InvertedIndex) termBitmap(snap lsm.Reader, term string) (*roaring.Bitmap, error) {
 	normalized := idx.normalizeWord(term)
 	if normalized == "" {
-		return roaring.New()
+		return roaring.New(), nil
 	}
-	return idx.loadPosting(normalized)
+	return idx.loadPosting(snap, normalized)
 }
 
 func applyOperator(op string, values *[]*roaring.Bitmap) error {
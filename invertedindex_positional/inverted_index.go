@@ -17,19 +17,25 @@ type InvertedIndex struct {
 
 type posting map[uint32][]uint32
 
-func NewInvertedIndex() *InvertedIndex {
-	return NewInvertedIndexWithLSM(1024, "invertedindex_positional_lsmdata")
+func NewInvertedIndex() (*InvertedIndex, error) {
+	return NewInvertedIndexWithLSM(4<<20, "invertedindex_positional_lsmdata")
 }
 
-func NewInvertedIndexWithLSM(maxSize int, dir string) *InvertedIndex {
-	return &InvertedIndex{
-		tree: lsm.InitWithDir(maxSize, dir),
+func NewInvertedIndexWithLSM(maxSize int, dir string) (*InvertedIndex, error) {
+	opts := lsm.DefaultOptions()
+	opts.MaxSize = maxSize
+	tree, err := lsm.Open(dir, opts)
+	if err != nil {
+		return nil, err
 	}
+	return &InvertedIndex{
+		tree: tree,
+	}, nil
 }
 
-func (idx *InvertedIndex) AddDocument(docID int, text string) {
+func (idx *InvertedIndex) AddDocument(docID int, text string) error {
 	if docID < 0 || docID > math.MaxUint32 {
-		return
+		return nil
 	}
 	id := uint32(docID)
 
@@ -39,11 +45,19 @@ func (idx *InvertedIndex) AddDocument(docID int, text string) {
 		termPositions[token] = append(termPositions[token], uint32(pos))
 	}
 
+	batch := lsm.NewWriteBatch()
 	for term, positions := range termPositions {
-		p := idx.loadPosting(term)
+		p, err := idx.loadPosting(idx.tree, term)
+		if err != nil {
+			return err
+		}
 		p[id] = positions
-		idx.storePosting(term, p)
+		idx.storePosting(batch, term, p)
 	}
+	if idx.tree == nil {
+		return nil
+	}
+	return idx.tree.Write(batch)
 }
 
 func (idx *InvertedIndex) Compact() error {
@@ -53,6 +67,21 @@ func (idx *InvertedIndex) Compact() error {
 	return idx.tree.Compact()
 }
 
+func (idx *InvertedIndex) Close() error {
+	if idx.tree == nil {
+		return nil
+	}
+	return idx.tree.Close()
+}
+
+func (idx *InvertedIndex) snapshot() (lsm.Reader, func()) {
+	if idx.tree == nil {
+		return nil, func() {}
+	}
+	snap := idx.tree.Snapshot()
+	return snap, snap.Release
+}
+
 func (idx *InvertedIndex) normalizeAndTokenize(text string) []string {
 	if text == "" {
 		return nil
@@ -84,22 +113,22 @@ func (idx *InvertedIndex) normalizeWord(word string) string {
 	return tokens[0]
 }
 
-func (idx *InvertedIndex) loadPosting(term string) posting {
+func (idx *InvertedIndex) loadPosting(r lsm.Reader, term string) (posting, error) {
 	if idx.tree == nil {
-		return make(posting)
+		return make(posting), nil
 	}
-	raw := idx.tree.Get(term)
-	if raw == nil {
-		return make(posting)
+	raw, err := r.GetErr(term)
+	if err != nil || raw == nil {
+		return make(posting), err
 	}
 	p := make(posting)
 	if err := gob.NewDecoder(bytes.NewReader([]byte(*raw))).Decode(&p); err != nil {
-		return make(posting)
+		return nil, err
 	}
-	return p
+	return p, nil
 }
 
-func (idx *InvertedIndex) storePosting(term string, p posting) {
+func (idx *InvertedIndex) storePosting(batch *lsm.WriteBatch, term string, p posting) {
 	if idx.tree == nil || p == nil {
 		return
 	}
@@ -108,5 +137,5 @@ func (idx *InvertedIndex) storePosting(term string, p posting) {
 		return
 	}
 	s := buf.String()
-	idx.tree.Put(term, &s)
+	batch.Put(term, &s)
 }
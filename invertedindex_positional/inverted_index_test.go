@@ -5,8 +5,17 @@ import (
 	"testing"
 )
 
+func newTestIndex(t *testing.T, maxSize int) *InvertedIndex {
+	t.Helper()
+	idx, err := NewInvertedIndexWithLSM(maxSize, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewInvertedIndexWithLSM: %v", err)
+	}
+	return idx
+}
+
 func TestPhraseSearch(t *testing.T) {
-	idx := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx := newTestIndex(t, 1024)
 	idx.AddDocument(1, "running fast with maps")
 	idx.AddDocument(2, "fast running with maps")
 	idx.AddDocument(3, "running quickly with maps")
@@ -37,7 +46,7 @@ func TestPhraseSearch(t *testing.T) {
 }
 
 func TestPhraseRepeatedTerms(t *testing.T) {
-	idx := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx := newTestIndex(t, 1024)
 	idx.AddDocument(1, "run run bloom")
 	idx.AddDocument(2, "run bloom bloom")
 	idx.AddDocument(3, "run bloom run bloom")
@@ -68,7 +77,7 @@ func TestPhraseRepeatedTerms(t *testing.T) {
 }
 
 func TestPhraseAfterCompact(t *testing.T) {
-	idx := NewInvertedIndexWithLSM(2, t.TempDir())
+	idx := newTestIndex(t, 2)
 	idx.AddDocument(1, "running fast maps")
 	idx.AddDocument(2, "maps fast running")
 	idx.AddDocument(3, "bitmap bloom index")
@@ -94,7 +103,7 @@ func TestPhraseAfterCompact(t *testing.T) {
 }
 
 func TestEmptyPhrase(t *testing.T) {
-	idx := NewInvertedIndexWithLSM(1024, t.TempDir())
+	idx := newTestIndex(t, 1024)
 	idx.AddDocument(1, "run bloom")
 	if _, err := idx.SearchPhrase(""); err == nil {
 		t.Fatalf("expected error for empty phrase")
@@ -10,11 +10,17 @@ func (idx *InvertedIndex) SearchPhrase(phrase string) ([]int, error) {
 	if len(terms) == 0 {
 		return nil, fmt.Errorf("empty phrase")
 	}
+	snap, release := idx.snapshot()
+	defer release()
 
 	postings := make([]posting, len(terms))
 	for i, t := range terms {
-		postings[i] = idx.loadPosting(t)
-		if len(postings[i]) == 0 {
+		p, err := idx.loadPosting(snap, t)
+		if err != nil {
+			return nil, err
+		}
+		postings[i] = p
+		if len(p) == 0 {
 			return nil, nil
 		}
 	}
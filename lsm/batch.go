@@ -0,0 +1,98 @@
+package lsm
+
+import "time"
+
+type WriteBatch struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	key   string
+	value VersionedValue
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key string, value *string) {
+	if value == nil {
+		b.Delete(key)
+		return
+	}
+	b.entries = append(b.entries, batchEntry{key: key, value: VersionedValue{value: value, kind: kindPut}})
+}
+
+func (b *WriteBatch) PutWithTTL(key string, value string, ttl time.Duration) {
+	b.entries = append(b.entries, batchEntry{key: key, value: VersionedValue{value: &value, kind: kindPut, expiresAt: expiryAfter(ttl)}})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, batchEntry{key: key, value: VersionedValue{kind: kindDelete}})
+}
+
+func (b *WriteBatch) Merge(key string, operand string) {
+	b.entries = append(b.entries, batchEntry{key: key, value: VersionedValue{value: &operand, kind: kindMerge}})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+func (l *LSM) Write(b *WriteBatch) error {
+	if b == nil || len(b.entries) == 0 {
+		return nil
+	}
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+
+	l.mutex.Lock()
+	if err := l.makeRoomLocked(); err != nil {
+		l.mutex.Unlock()
+		return err
+	}
+	mem, seq := l.memTable, l.sequenceNumber
+	// Readers keep reading at seq until the batch is published below, so
+	// the versions they see must survive the collapse as if seq were a
+	// snapshot.
+	snapshots := append(l.snapshotsLocked(), seq)
+	l.mutex.Unlock()
+
+	entries := make([]batchEntry, len(b.entries))
+	staged := make(map[string][]VersionedValue, len(b.entries))
+	for i, e := range b.entries {
+		e.value.sequenceNumber = seq + uint32(i)
+		prev, ok := staged[e.key]
+		if !ok {
+			prev = mem.versions(e.key)
+		}
+		versions, err := prependVersion(e.key, prev, e.value, snapshots, l.mergeOperator)
+		if err != nil {
+			return err
+		}
+		staged[e.key] = versions
+		entries[i] = e
+	}
+	if l.wal != nil {
+		if err := l.wal.append(entries); err != nil {
+			if serr := l.wal.abandonSegment(); serr != nil {
+				l.mutex.Lock()
+				l.setBackgroundErrorLocked(serr)
+				l.mutex.Unlock()
+			}
+			return err
+		}
+	}
+	for key, versions := range staged {
+		mem.set(key, versions)
+	}
+
+	l.mutex.Lock()
+	l.sequenceNumber += uint32(len(entries))
+	l.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,412 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var errBadBlock = errors.New("sstable: malformed block")
+
+const blockRestartInterval = 16
+
+type blockHandle struct {
+	firstKey string
+	offset   uint64
+	length   uint32
+}
+
+type blockEntry struct {
+	key   string
+	value VersionedValue
+}
+
+func appendRecord(b []byte, v VersionedValue) []byte {
+	if v.pointer != nil {
+		b = append(b, byte(kindPutPointer))
+		b = binary.LittleEndian.AppendUint64(b, v.pointer.fileID)
+		b = binary.LittleEndian.AppendUint64(b, v.pointer.offset)
+		b = binary.LittleEndian.AppendUint32(b, v.pointer.length)
+		b = binary.LittleEndian.AppendUint64(b, uint64(v.expiresAt))
+		return binary.LittleEndian.AppendUint32(b, v.sequenceNumber)
+	}
+	kind := v.kind
+	if kind == kindPut && v.expiresAt != 0 {
+		kind = kindPutExpiring
+	}
+	b = append(b, byte(kind))
+	if v.kind != kindDelete {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(*v.value)))
+		b = append(b, *v.value...)
+	}
+	if kind == kindPutExpiring {
+		b = binary.LittleEndian.AppendUint64(b, uint64(v.expiresAt))
+	}
+	return binary.LittleEndian.AppendUint32(b, v.sequenceNumber)
+}
+
+func appendBlockEntry(b []byte, key string, shared int, v VersionedValue) []byte {
+	b = binary.AppendUvarint(b, uint64(shared))
+	b = binary.AppendUvarint(b, uint64(len(key)-shared))
+	b = append(b, key[shared:]...)
+	return appendRecord(b, v)
+}
+
+func appendRestarts(b []byte, restarts []uint32) []byte {
+	for _, off := range restarts {
+		b = binary.LittleEndian.AppendUint32(b, off)
+	}
+	return binary.LittleEndian.AppendUint32(b, uint32(len(restarts)))
+}
+
+func sharedPrefixLen(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+func decodeRecord(b []byte, withValue bool) (VersionedValue, int, error) {
+	if len(b) < 1 {
+		return VersionedValue{}, 0, errBadBlock
+	}
+	kind := valueKind(b[0])
+	v := VersionedValue{kind: kind}
+	if kind == kindPutPointer {
+		if len(b) < 33 {
+			return VersionedValue{}, 0, errBadBlock
+		}
+		v.kind = kindPut
+		v.pointer = &valuePointer{
+			fileID: binary.LittleEndian.Uint64(b[1:9]),
+			offset: binary.LittleEndian.Uint64(b[9:17]),
+			length: binary.LittleEndian.Uint32(b[17:21]),
+		}
+		v.expiresAt = int64(binary.LittleEndian.Uint64(b[21:29]))
+		v.sequenceNumber = binary.LittleEndian.Uint32(b[29:33])
+		return v, 33, nil
+	}
+	if kind == kindPutExpiring {
+		v.kind = kindPut
+	}
+	pos := 1
+	if v.kind != kindDelete {
+		if len(b) < pos+4 {
+			return VersionedValue{}, 0, errBadBlock
+		}
+		n := int(binary.LittleEndian.Uint32(b[pos:]))
+		pos += 4
+		if len(b) < pos+n {
+			return VersionedValue{}, 0, errBadBlock
+		}
+		if withValue {
+			val := string(b[pos : pos+n])
+			v.value = &val
+		}
+		pos += n
+	}
+	if kind == kindPutExpiring {
+		if len(b) < pos+8 {
+			return VersionedValue{}, 0, errBadBlock
+		}
+		v.expiresAt = int64(binary.LittleEndian.Uint64(b[pos:]))
+		pos += 8
+	}
+	if len(b) < pos+4 {
+		return VersionedValue{}, 0, errBadBlock
+	}
+	v.sequenceNumber = binary.LittleEndian.Uint32(b[pos:])
+	return v, pos + 4, nil
+}
+
+func decodeBlockKey(b []byte) (string, int, error) {
+	n, sz := binary.Uvarint(b)
+	if sz <= 0 || uint64(len(b)-sz) < n {
+		return "", 0, errBadBlock
+	}
+	return string(b[sz : sz+int(n)]), sz + int(n), nil
+}
+
+func decodePrefixedKey(b []byte, prev string) (string, int, error) {
+	shared, n1 := binary.Uvarint(b)
+	if n1 <= 0 || shared > uint64(len(prev)) {
+		return "", 0, errBadBlock
+	}
+	unshared, n2 := binary.Uvarint(b[n1:])
+	if n2 <= 0 || uint64(len(b)-n1-n2) < unshared {
+		return "", 0, errBadBlock
+	}
+	pos := n1 + n2
+	return prev[:shared] + string(b[pos:pos+int(unshared)]), pos + int(unshared), nil
+}
+
+func nextBlockKey(b []byte, prev string, prefixed bool) (string, int, error) {
+	if prefixed {
+		return decodePrefixedKey(b, prev)
+	}
+	return decodeBlockKey(b)
+}
+
+func splitRestarts(data []byte) ([]byte, []uint32, error) {
+	if len(data) < 4 {
+		return nil, nil, errBadBlock
+	}
+	n := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if uint64(n)*4+4 > uint64(len(data)) {
+		return nil, nil, errBadBlock
+	}
+	bodyLen := len(data) - 4 - int(n)*4
+	body := data[:bodyLen]
+	restarts := make([]uint32, n)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(data[bodyLen+i*4:])
+		if restarts[i] >= uint32(len(body)) || (i == 0 && restarts[i] != 0) || (i > 0 && restarts[i] <= restarts[i-1]) {
+			return nil, nil, errBadBlock
+		}
+	}
+	if len(body) > 0 && n == 0 {
+		return nil, nil, errBadBlock
+	}
+	return body, restarts, nil
+}
+
+func searchBlock(data []byte, key string, prefixed bool) ([]VersionedValue, error) {
+	if prefixed {
+		body, restarts, err := splitRestarts(data)
+		if err != nil {
+			return nil, err
+		}
+		var searchErr error
+		r := sort.Search(len(restarts), func(i int) bool {
+			k, _, err := decodePrefixedKey(body[restarts[i]:], "")
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			return k >= key
+		}) - 1
+		if searchErr != nil {
+			return nil, searchErr
+		}
+		data = body
+		if r >= 0 {
+			data = body[restarts[r]:]
+		}
+	}
+
+	var versions []VersionedValue
+	var k string
+	for len(data) > 0 {
+		var n int
+		var err error
+		k, n, err = nextBlockKey(data, k, prefixed)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		if k > key {
+			break
+		}
+		v, n, err := decodeRecord(data, k == key)
+		if err != nil {
+			return nil, err
+		}
+		if k == key {
+			versions = append(versions, v)
+		}
+		data = data[n:]
+	}
+	return versions, nil
+}
+
+func decodeBlock(data []byte, prefixed bool) ([]blockEntry, error) {
+	if prefixed {
+		var err error
+		if data, _, err = splitRestarts(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []blockEntry
+	var k string
+	for len(data) > 0 {
+		var n int
+		var err error
+		k, n, err = nextBlockKey(data, k, prefixed)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		v, n, err := decodeRecord(data, true)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		entries = append(entries, blockEntry{key: k, value: v})
+	}
+	return entries, nil
+}
+
+func encodeIndexBlock(blocks []blockHandle, lastKey string) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(blocks)))
+	prev := ""
+	for _, h := range blocks {
+		shared := sharedPrefixLen(prev, h.firstKey)
+		b = binary.AppendUvarint(b, uint64(shared))
+		b = binary.AppendUvarint(b, uint64(len(h.firstKey)-shared))
+		b = append(b, h.firstKey[shared:]...)
+		prev = h.firstKey
+		b = binary.AppendUvarint(b, h.offset)
+		b = binary.AppendUvarint(b, uint64(h.length))
+	}
+	b = binary.AppendUvarint(b, uint64(len(lastKey)))
+	return append(b, lastKey...)
+}
+
+func decodeIndexBlock(b []byte, prefixed bool) ([]blockHandle, string, error) {
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errBadBlock
+		}
+		b = b[n:]
+		return v, nil
+	}
+	readKey := func() (string, error) {
+		k, n, err := decodeBlockKey(b)
+		if err != nil {
+			return "", err
+		}
+		b = b[n:]
+		return k, nil
+	}
+
+	count, err := readUvarint()
+	if err != nil {
+		return nil, "", err
+	}
+	if count > uint64(len(b)) {
+		return nil, "", errBadBlock
+	}
+	blocks := make([]blockHandle, 0, count)
+	prev := ""
+	for i := uint64(0); i < count; i++ {
+		k, n, err := nextBlockKey(b, prev, prefixed)
+		if err != nil {
+			return nil, "", err
+		}
+		b = b[n:]
+		prev = k
+		off, err := readUvarint()
+		if err != nil {
+			return nil, "", err
+		}
+		length, err := readUvarint()
+		if err != nil {
+			return nil, "", err
+		}
+		blocks = append(blocks, blockHandle{firstKey: k, offset: off, length: uint32(length)})
+	}
+	lastKey, err := readKey()
+	if err != nil {
+		return nil, "", err
+	}
+	return blocks, lastKey, nil
+}
+
+type blockIterator struct {
+	t       *SSTable
+	reverse bool
+	block   int
+	entries []blockEntry
+	pos     int
+	lastErr error
+}
+
+func (it *blockIterator) first() {
+	if it.reverse {
+		it.loadBlock(len(it.t.blocks) - 1)
+		it.pos = len(it.entries) - 1
+	} else {
+		it.loadBlock(0)
+		it.pos = 0
+	}
+}
+
+func (it *blockIterator) seek(key string) {
+	i := it.t.blockFor(key)
+	if i < 0 {
+		if it.reverse {
+			it.loadBlock(-1)
+			return
+		}
+		i = 0
+	}
+	it.loadBlock(i)
+	if it.reverse {
+		pos := sort.Search(len(it.entries), func(j int) bool { return it.entries[j].key > key }) - 1
+		it.pos = pos
+		if pos < 0 {
+			it.next()
+		}
+		return
+	}
+	pos := sort.Search(len(it.entries), func(j int) bool { return it.entries[j].key >= key })
+	it.pos = pos
+	if pos == len(it.entries) {
+		it.pos--
+		it.next()
+	}
+}
+
+func (it *blockIterator) next() {
+	if it.reverse {
+		it.pos--
+		if it.pos < 0 {
+			it.loadBlock(it.block - 1)
+			it.pos = len(it.entries) - 1
+		}
+		return
+	}
+	it.pos++
+	if it.pos >= len(it.entries) {
+		it.loadBlock(it.block + 1)
+		it.pos = 0
+	}
+}
+
+func (it *blockIterator) loadBlock(i int) {
+	it.block = i
+	it.entries = nil
+	if i < 0 || i >= len(it.t.blocks) {
+		return
+	}
+	var entries []blockEntry
+	err := it.t.readBlock(i, func(data []byte) (err error) {
+		entries, err = decodeBlock(data, it.t.version >= sstFormatPrefixed)
+		return it.t.corruption(it.t.blocks[i].offset, err)
+	})
+	if err != nil {
+		it.lastErr = err
+		return
+	}
+	if it.t.hasGlobalSeq {
+		for j := range entries {
+			entries[j].value.sequenceNumber = it.t.globalSeq
+		}
+	}
+	it.entries = entries
+}
+
+func (it *blockIterator) valid() bool {
+	return it.lastErr == nil && it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *blockIterator) key() string { return it.entries[it.pos].key }
+
+func (it *blockIterator) value() (VersionedValue, error) { return it.entries[it.pos].value, nil }
+
+func (it *blockIterator) err() error { return it.lastErr }
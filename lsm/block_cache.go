@@ -0,0 +1,86 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+type blockCacheKey struct {
+	table  uint64
+	offset uint64
+}
+
+type blockCacheEntry struct {
+	key  blockCacheKey
+	data []byte
+}
+
+type BlockCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	items    map[blockCacheKey]*list.Element
+}
+
+func NewBlockCache(capacityBytes int64) *BlockCache {
+	return &BlockCache{
+		capacity: capacityBytes,
+		lru:      list.New(),
+		items:    make(map[blockCacheKey]*list.Element),
+	}
+}
+
+func (c *BlockCache) get(table, offset uint64) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.items[blockCacheKey{table: table, offset: offset}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*blockCacheEntry).data, true
+}
+
+func (c *BlockCache) add(table, offset uint64, data []byte) {
+	if int64(len(data)) > c.capacity {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := blockCacheKey{table: table, offset: offset}
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&blockCacheEntry{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*blockCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.items, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+func (c *BlockCache) evictTable(table uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*blockCacheEntry)
+		if entry.key.table == table {
+			c.lru.Remove(e)
+			delete(c.items, entry.key)
+			c.size -= int64(len(entry.data))
+		}
+		e = next
+	}
+}
+
+func (c *BlockCache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
@@ -1,40 +1,97 @@
 package lsm
 
-import "hash/fnv"
+import (
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
 
 type BloomFilter struct {
-	mBits uint64
-	bits  []uint64
+	mBits  uint64
+	hashes uint32
+	bits   []uint64
 }
 
 const (
 	bloomMixConst uint64 = 1791791791
 	bloomShift           = 33
+
+	defaultBloomBitsPerKey = 10
+	maxBloomHashes         = 30
 )
 
+type BloomPolicy struct {
+	BitsPerKey        float64
+	FalsePositiveRate float64
+}
+
+func (p BloomPolicy) bitsPerKey() float64 {
+	if p.FalsePositiveRate > 0 && p.FalsePositiveRate < 1 {
+		return BloomBitsPerKeyForFalsePositiveRate(p.FalsePositiveRate)
+	}
+	return p.BitsPerKey
+}
+
+func BloomBitsPerKeyForFalsePositiveRate(rate float64) float64 {
+	return -math.Log(rate) / (math.Ln2 * math.Ln2)
+}
+
+func bloomHashCount(bitsPerKey float64) uint32 {
+	k := uint32(math.Round(bitsPerKey * math.Ln2))
+	return min(max(k, 1), maxBloomHashes)
+}
+
 func NewBloomFilter(expectedItems int) *BloomFilter {
+	return NewBloomFilterWithBitsPerKey(expectedItems, defaultBloomBitsPerKey)
+}
+
+func NewBloomFilterWithBitsPerKey(expectedItems int, bitsPerKey float64) *BloomFilter {
 	if expectedItems < 1 {
 		expectedItems = 1
 	}
+	if bitsPerKey <= 0 {
+		bitsPerKey = defaultBloomBitsPerKey
+	}
 
-	m := max(uint64(expectedItems * 10), 64)
+	m := max(uint64(math.Ceil(float64(expectedItems)*bitsPerKey)), 64)
 
 	wordCount := (m + 63) / 64
 	return &BloomFilter{
-		mBits: m,
-		bits:  make([]uint64, wordCount),
+		mBits:  m,
+		hashes: bloomHashCount(bitsPerKey),
+		bits:   make([]uint64, wordCount),
 	}
 }
 
 func (b *BloomFilter) AddString(s string) {
-	h1, h2 := bloomHashes(s)
-	b.setBit(h1 % b.mBits)
-	b.setBit(h2 % b.mBits)
+	b.addHash(bloomHash(s))
+}
+
+func (b *BloomFilter) addHash(h uint64) {
+	h1, h2 := bloomHashPair(h)
+	if b.hashes == 0 {
+		b.setBit(h1 % b.mBits)
+		b.setBit(h2 % b.mBits)
+		return
+	}
+	for i := uint32(0); i < b.hashes; i++ {
+		b.setBit(h1 % b.mBits)
+		h1 += h2
+	}
 }
 
 func (b *BloomFilter) MightContainString(s string) bool {
 	h1, h2 := bloomHashes(s)
-	return b.getBit(h1 % b.mBits) && b.getBit(h2 % b.mBits)
+	if b.hashes == 0 {
+		return b.getBit(h1%b.mBits) && b.getBit(h2%b.mBits)
+	}
+	for i := uint32(0); i < b.hashes; i++ {
+		if !b.getBit(h1 % b.mBits) {
+			return false
+		}
+		h1 += h2
+	}
+	return true
 }
 
 func (b *BloomFilter) setBit(bit uint64) {
@@ -50,12 +107,51 @@ func (b *BloomFilter) getBit(bit uint64) bool {
 }
 
 func bloomHashes(s string) (uint64, uint64) {
+	return bloomHashPair(bloomHash(s))
+}
+
+func bloomHash(s string) uint64 {
 	h := fnv.New64a()
 	_, _ = h.Write([]byte(s))
-	sum1 := h.Sum64()
+	return h.Sum64()
+}
+
+func bloomHashPair(sum1 uint64) (uint64, uint64) {
 	sum2 := (sum1 >> bloomShift) ^ (sum1 * bloomMixConst)
 	if sum2 == 0 {
 		sum2 = bloomMixConst
 	}
 	return sum1, sum2
 }
+
+type BloomStats struct {
+	Checks         uint64
+	Negatives      uint64
+	FalsePositives uint64
+}
+
+type bloomCounters struct {
+	checks         atomic.Uint64
+	negatives      atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+func (c *bloomCounters) record(mightContain, found bool) {
+	if c == nil {
+		return
+	}
+	c.checks.Add(1)
+	if !mightContain {
+		c.negatives.Add(1)
+	} else if !found {
+		c.falsePositives.Add(1)
+	}
+}
+
+func (c *bloomCounters) stats() BloomStats {
+	return BloomStats{
+		Checks:         c.checks.Load(),
+		Negatives:      c.negatives.Load(),
+		FalsePositives: c.falsePositives.Load(),
+	}
+}
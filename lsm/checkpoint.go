@@ -0,0 +1,163 @@
+package lsm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var errCheckpointDirNotEmpty = errors.New("lsm: checkpoint directory is not empty")
+
+type checkpointFile struct {
+	path string
+	size uint64
+}
+
+type BackupResult struct {
+	Tables      int
+	ValueLogs   int
+	Copied      int
+	CopiedBytes uint64
+}
+
+func (l *LSM) Checkpoint(dir string) error {
+	_, err := l.checkpoint(dir, "", true)
+	return err
+}
+
+func (l *LSM) Backup(dir, previous string) (BackupResult, error) {
+	return l.checkpoint(dir, previous, false)
+}
+
+func (l *LSM) checkpoint(dir, previous string, link bool) (BackupResult, error) {
+	var res BackupResult
+	if err := prepareCheckpointDir(l.fs, dir); err != nil {
+		return res, err
+	}
+	tables, edit, err := l.pinCurrentTables()
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		for _, t := range tables {
+			t.release()
+		}
+	}()
+	if err := l.values.seal(); err != nil {
+		return res, err
+	}
+
+	var files []checkpointFile
+	valueFiles := make(map[uint64]bool)
+	for _, t := range tables {
+		files = append(files, checkpointFile{path: t.Path(), size: t.size})
+		for _, id := range t.valueFiles {
+			valueFiles[id] = true
+		}
+	}
+	for id := range valueFiles {
+		path := filepath.Join(l.dir, valueLogName(id))
+		st, err := l.fs.Stat(path)
+		if err != nil {
+			return res, err
+		}
+		files = append(files, checkpointFile{path: path, size: uint64(st.Size())})
+	}
+
+	res.Tables, res.ValueLogs = len(tables), len(valueFiles)
+	for _, f := range files {
+		name := filepath.Base(f.path)
+		dst := filepath.Join(dir, name)
+		src, tryLink := f.path, link
+		if previous != "" {
+			prev := filepath.Join(previous, name)
+			if st, err := l.fs.Stat(prev); err == nil && uint64(st.Size()) == f.size {
+				src, tryLink = prev, true
+			}
+		}
+		if tryLink && l.fs.Link(src, dst) == nil {
+			continue
+		}
+		if err := copyFile(l.fs, src, dst); err != nil {
+			return res, err
+		}
+		res.Copied++
+		res.CopiedBytes += f.size
+	}
+	if err := l.fs.SyncDir(dir); err != nil {
+		return res, err
+	}
+	m, err := createManifest(l.fs, dir, edit)
+	if err != nil {
+		return res, err
+	}
+	return res, m.close()
+}
+
+func (l *LSM) pinCurrentTables() ([]*SSTable, versionEdit, error) {
+	l.writeMutex.Lock()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		l.writeMutex.Unlock()
+		return nil, versionEdit{}, ErrClosed
+	}
+	if l.bgErr == nil {
+		if err := l.rotateMemTableLocked(); err != nil {
+			l.writeMutex.Unlock()
+			return nil, versionEdit{}, err
+		}
+	}
+	l.writeMutex.Unlock()
+	for l.bgErr == nil && len(l.immutables) > 0 {
+		l.cond.Wait()
+	}
+	if l.bgErr != nil {
+		return nil, versionEdit{}, l.bgErr
+	}
+
+	var tables []*SSTable
+	for _, level := range l.files {
+		for _, t := range level {
+			t.acquire()
+			tables = append(tables, t)
+		}
+	}
+	return tables, l.snapshotEditLocked(), nil
+}
+
+func prepareCheckpointDir(fs FS, dir string) error {
+	entries, err := fs.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return fs.MkdirAll(dir, 0o755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return errCheckpointDirNotEmpty
+	}
+	return nil
+}
+
+func copyFile(fs FS, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,296 @@
+package lsm
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type compaction struct {
+	level     int
+	next      int
+	inputs    []*SSTable
+	overlaps  []*SSTable
+	bottom    bool
+	snapshots []uint32
+}
+
+func (l *LSM) pickCompactionLevelLocked() int {
+	best, bestScore := -1, 1.0
+	for level := 0; level < len(l.files) && level < l.maxLevels-1; level++ {
+		var score float64
+		if level == 0 {
+			if anyCompacting(l.files[0]) {
+				continue
+			}
+			score = float64(len(l.files[0])) / float64(max(l.maxFilesPerLevel, 1))
+		} else {
+			if l.pickFileLocked(level) == nil {
+				continue
+			}
+			score = float64(tablesBytes(l.files[level])) / float64(l.levelTargetBytes(level))
+		}
+		if score > bestScore {
+			best, bestScore = level, score
+		}
+	}
+	return best
+}
+
+func (l *LSM) levelTargetBytes(level int) uint64 {
+	target := l.baseLevelBytes
+	for i := 1; i < level; i++ {
+		target *= l.levelSizeMultiplier
+	}
+	return max(target, 1)
+}
+
+func (l *LSM) pickCompactionLocked() (*compaction, error) {
+	for {
+		level := l.pickCompactionLevelLocked()
+		if level < 0 {
+			return nil, nil
+		}
+		next := level + 1
+		l.ensureLevelLocked(next)
+		for len(l.compactPointers) <= level {
+			l.compactPointers = append(l.compactPointers, "")
+		}
+
+		var inputs []*SSTable
+		if level == 0 {
+			inputs = append(inputs, l.files[0]...)
+		} else {
+			inputs = []*SSTable{l.pickFileLocked(level)}
+		}
+		lo, hi, ok := keyRange(inputs)
+		var overlaps []*SSTable
+		if ok {
+			overlaps = overlappingTables(l.files[next], lo, hi)
+		}
+		if anyCompacting(overlaps) {
+			return nil, nil
+		}
+		if level > 0 && len(overlaps) == 0 {
+			l.compactPointers[level] = hi
+			if err := l.moveTableLocked(level, next, inputs[0]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		c := &compaction{
+			level:     level,
+			next:      next,
+			inputs:    inputs,
+			overlaps:  overlaps,
+			bottom:    !ok || !l.keysMayExistBeyondLocked(next, lo, hi),
+			snapshots: l.snapshotsLocked(),
+		}
+		for _, t := range c.all() {
+			t.compacting = true
+		}
+		l.compactPointers[level] = hi
+		return c, nil
+	}
+}
+
+func (c *compaction) all() []*SSTable {
+	return append(append([]*SSTable(nil), c.inputs...), c.overlaps...)
+}
+
+func (l *LSM) runCompactionLocked(c *compaction) {
+	l.runningCompactions++
+	all := c.all()
+	l.mutex.Unlock()
+
+	start := time.Now()
+	outputs, err := compactSSTables(func() string {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return l.newFilePathLocked(c.next)
+	}, l.tableOptsForLevel(c.next), mergePolicy{
+		op:        l.mergeOperator,
+		bottom:    c.bottom,
+		snapshots: c.snapshots,
+		filter:    l.compactionFilter,
+		level:     c.next,
+		values:    l.values,
+	}, l.targetFileSize, l.maxSubcompactions, all...)
+	if err == nil {
+		var written uint64
+		for _, t := range outputs {
+			written += t.size
+		}
+		l.metrics.compactions.record(time.Since(start), written)
+		err = l.fs.SyncDir(l.dir)
+	}
+
+	l.mutex.Lock()
+	l.runningCompactions--
+	defer l.cond.Broadcast()
+	for _, t := range all {
+		t.compacting = false
+	}
+	if err == nil {
+		err = l.installCompactionLocked(c, outputs)
+	} else {
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+			t.release()
+		}
+	}
+	if err != nil {
+		l.setBackgroundErrorLocked(err)
+	}
+}
+
+func (l *LSM) installCompactionLocked(c *compaction, outputs []*SSTable) error {
+	all := c.all()
+	edit := versionEdit{}
+	for _, t := range outputs {
+		edit.added = append(edit.added, t.manifestTable(c.next))
+	}
+	for _, t := range all {
+		edit.deleted = append(edit.deleted, filepath.Base(t.Path()))
+	}
+	if err := l.logEditLocked(edit); err != nil {
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+			t.release()
+		}
+		return err
+	}
+
+	l.files[c.level] = removeTables(l.files[c.level], c.inputs)
+	l.files[c.next] = append(removeTables(l.files[c.next], c.overlaps), outputs...)
+	sortByMinKey(l.files[c.next])
+
+	for _, t := range all {
+		t.obsolete.Store(true)
+		t.release()
+	}
+	return nil
+}
+
+func (l *LSM) moveTableLocked(from, to int, t *SSTable) error {
+	name := filepath.Base(t.Path())
+	edit := versionEdit{
+		added:   []manifestTable{t.manifestTable(to)},
+		deleted: []string{name},
+	}
+	if err := l.logEditLocked(edit); err != nil {
+		return err
+	}
+	l.files[from] = removeTables(l.files[from], []*SSTable{t})
+	l.files[to] = append(l.files[to], t)
+	sortByMinKey(l.files[to])
+	return nil
+}
+
+func (l *LSM) pickFileLocked(level int) *SSTable {
+	var pointer string
+	if level < len(l.compactPointers) {
+		pointer = l.compactPointers[level]
+	}
+	var first *SSTable
+	for _, t := range l.files[level] {
+		if t.compacting {
+			continue
+		}
+		if first == nil {
+			first = t
+		}
+		if t.minKey > pointer {
+			return t
+		}
+	}
+	return first
+}
+
+func (l *LSM) keysMayExistBeyondLocked(level int, lo, hi string) bool {
+	for i := level + 1; i < len(l.files); i++ {
+		if len(overlappingTables(l.files[i], lo, hi)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func keyRange(tables []*SSTable) (string, string, bool) {
+	var lo, hi string
+	found := false
+	for _, t := range tables {
+		if t.keyCount == 0 {
+			continue
+		}
+		if !found || t.minKey < lo {
+			lo = t.minKey
+		}
+		if !found || t.maxKey > hi {
+			hi = t.maxKey
+		}
+		found = true
+	}
+	return lo, hi, found
+}
+
+func overlappingTables(tables []*SSTable, lo, hi string) []*SSTable {
+	var out []*SSTable
+	for _, t := range tables {
+		if t.keyCount > 0 && t.minKey <= hi && t.maxKey >= lo {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func anyCompacting(tables []*SSTable) bool {
+	for _, t := range tables {
+		if t.compacting {
+			return true
+		}
+	}
+	return false
+}
+
+func removeTables(tables, remove []*SSTable) []*SSTable {
+	out := tables[:0:0]
+	for _, t := range tables {
+		keep := true
+		for _, r := range remove {
+			if t == r {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func tablesBytes(tables []*SSTable) uint64 {
+	var n uint64
+	for _, t := range tables {
+		n += t.size
+	}
+	return n
+}
+
+func sortByMinKey(tables []*SSTable) {
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i].minKey < tables[j].minKey
+	})
+}
+
+func findTableForKey(tables []*SSTable, key string) *SSTable {
+	i := sort.Search(len(tables), func(i int) bool {
+		return tables[i].maxKey >= key
+	})
+	if i == len(tables) || tables[i].keyCount == 0 || tables[i].minKey > key {
+		return nil
+	}
+	return tables[i]
+}
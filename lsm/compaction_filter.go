@@ -0,0 +1,50 @@
+package lsm
+
+type FilterDecision uint8
+
+const (
+	FilterKeep FilterDecision = iota
+	FilterRemove
+	FilterChange
+)
+
+// CompactionFilter sees the newest value of every key a compaction writes and
+// may keep it, remove it or replace it. Values still visible to a snapshot are
+// not offered to the filter.
+type CompactionFilter interface {
+	Name() string
+	Filter(level int, key string, value string) (FilterDecision, string)
+}
+
+type mergePolicy struct {
+	op        MergeOperator
+	bottom    bool
+	snapshots []uint32
+	filter    CompactionFilter
+	level     int
+	values    *valueLog
+}
+
+func (p mergePolicy) filterVersions(key string, versions []VersionedValue) ([]VersionedValue, error) {
+	if p.filter == nil || len(versions) == 0 {
+		return versions, nil
+	}
+	newest := versions[0]
+	if newest.kind != kindPut || (len(p.snapshots) > 0 && newest.sequenceNumber < p.snapshots[len(p.snapshots)-1]) {
+		return versions, nil
+	}
+	if err := p.values.load(&newest); err != nil {
+		return nil, err
+	}
+	decision, value := p.filter.Filter(p.level, key, *newest.value)
+	switch decision {
+	case FilterRemove:
+		if p.bottom && len(versions) == 1 {
+			return nil, nil
+		}
+		versions[0] = VersionedValue{sequenceNumber: newest.sequenceNumber, kind: kindDelete}
+	case FilterChange:
+		versions[0].value, versions[0].pointer = &value, nil
+	}
+	return versions, nil
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionFlate
+	CompressionSnappy
+)
+
+var errUnknownCompression = errors.New("sstable: unknown block compression")
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return "unknown"
+}
+
+func compressBlock(dst []byte, c Compression, raw []byte) ([]byte, error) {
+	var out []byte
+	switch c {
+	case CompressionNone:
+	case CompressionFlate:
+		var buf bytes.Buffer
+		fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := fw.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	case CompressionSnappy:
+		out = snappy.Encode(nil, raw)
+	default:
+		return nil, errUnknownCompression
+	}
+	if out == nil || len(out) >= len(raw)-len(raw)/8 {
+		out, c = raw, CompressionNone
+	}
+	dst = append(dst, out...)
+	return append(dst, byte(c)), nil
+}
+
+func decompressBlock(b []byte) ([]byte, error) {
+	if len(b) < 1 {
+		return nil, errBadBlock
+	}
+	payload := b[:len(b)-1]
+	switch Compression(b[len(b)-1]) {
+	case CompressionNone:
+		return payload, nil
+	case CompressionFlate:
+		fr := flate.NewReader(bytes.NewReader(payload))
+		defer fr.Close()
+		return io.ReadAll(fr)
+	case CompressionSnappy:
+		return snappy.Decode(nil, payload)
+	}
+	return nil, errUnknownCompression
+}
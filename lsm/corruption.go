@@ -0,0 +1,188 @@
+package lsm
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+var (
+	ErrCorruption       = errors.New("lsm: corruption")
+	errChecksumMismatch = errors.New("sstable: checksum mismatch")
+	errBadFooter        = errors.New("sstable: bad footer")
+)
+
+type CorruptionError struct {
+	Path   string
+	Offset uint64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: corruption at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error { return e.Err }
+
+func (e *CorruptionError) Is(target error) bool { return target == ErrCorruption }
+
+type DamagedRange struct {
+	Path     string
+	Level    int
+	StartKey string
+	EndKey   string
+	Err      error
+}
+
+func (s *SSTable) corruption(offset uint64, err error) error {
+	if err == nil || errors.Is(err, ErrCorruption) || !isFormatError(err) {
+		return err
+	}
+	return &CorruptionError{Path: s.path, Offset: offset, Err: err}
+}
+
+func isFormatError(err error) bool {
+	var flateErr flate.CorruptInputError
+	return errors.Is(err, errBadBlock) ||
+		errors.Is(err, errBadFooter) ||
+		errors.Is(err, errChecksumMismatch) ||
+		errors.Is(err, errUnknownCompression) ||
+		errors.Is(err, snappy.ErrCorrupt) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &flateErr)
+}
+
+func appendChecksum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+func verifyChecksum(b []byte) ([]byte, error) {
+	if len(b) < 4 {
+		return nil, errChecksumMismatch
+	}
+	payload := b[:len(b)-4]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return nil, errChecksumMismatch
+	}
+	return payload, nil
+}
+
+func (l *LSM) Verify() ([]DamagedRange, error) {
+	l.mutex.RLock()
+	type levelTable struct {
+		level int
+		t     *SSTable
+	}
+	var tables []levelTable
+	for level, files := range l.files {
+		for _, t := range files {
+			t.acquire()
+			tables = append(tables, levelTable{level: level, t: t})
+		}
+	}
+	l.mutex.RUnlock()
+	defer func() {
+		for _, lt := range tables {
+			lt.t.release()
+		}
+	}()
+
+	var damaged []DamagedRange
+	for _, lt := range tables {
+		ranges, err := lt.t.verify()
+		if err != nil {
+			return damaged, err
+		}
+		for _, r := range ranges {
+			r.Level = lt.level
+			damaged = append(damaged, r)
+		}
+	}
+	return damaged, nil
+}
+
+func (s *SSTable) verify() ([]DamagedRange, error) {
+	if s.version == sstFormatV1 {
+		return s.verifyV1()
+	}
+
+	var damaged []DamagedRange
+	count := 0
+	for i, h := range s.blocks {
+		end := s.maxKey
+		if i+1 < len(s.blocks) {
+			end = s.blocks[i+1].firstKey
+		}
+		data, err := s.readBlockFromFile(h)
+		var entries []blockEntry
+		if err == nil {
+			entries, err = decodeBlock(data, s.version >= sstFormatPrefixed)
+		}
+		if err == nil {
+			err = checkBlockEntries(entries, h.firstKey, end, i+1 == len(s.blocks))
+		}
+		if err != nil {
+			if err = s.corruption(h.offset, err); !errors.Is(err, ErrCorruption) {
+				return nil, err
+			}
+			damaged = append(damaged, DamagedRange{Path: s.path, StartKey: h.firstKey, EndKey: end, Err: err})
+			continue
+		}
+		count += len(entries)
+	}
+	if len(damaged) == 0 && count != s.keyCount {
+		err := &CorruptionError{Path: s.path, Err: fmt.Errorf("sstable: header counts %d keys, blocks hold %d", s.keyCount, count)}
+		damaged = append(damaged, DamagedRange{Path: s.path, StartKey: s.minKey, EndKey: s.maxKey, Err: err})
+	}
+	return damaged, nil
+}
+
+func checkBlockEntries(entries []blockEntry, first, end string, last bool) error {
+	if len(entries) == 0 || entries[0].key != first {
+		return errBadBlock
+	}
+	for i, e := range entries {
+		if i > 0 && (e.key < entries[i-1].key || (e.key == entries[i-1].key && e.value.sequenceNumber >= entries[i-1].value.sequenceNumber)) {
+			return errBadBlock
+		}
+		if (last && e.key > end) || (!last && e.key >= end) {
+			return errBadBlock
+		}
+	}
+	return nil
+}
+
+func (s *SSTable) verifyV1() ([]DamagedRange, error) {
+	it := &v1Iterator{t: s}
+	start := s.minKey
+	count := 0
+	for it.first(); it.valid(); it.next() {
+		if it.key() < start || (count > 0 && it.key() == start) {
+			it.lastErr = errBadBlock
+			break
+		}
+		start = it.key()
+		if _, err := it.value(); err != nil {
+			it.lastErr = err
+			break
+		}
+		count++
+	}
+	err := it.err()
+	if err == nil && count != s.keyCount {
+		err = errBadBlock
+	}
+	if err == nil {
+		return nil, nil
+	}
+	if err = s.corruption(0, err); !errors.Is(err, ErrCorruption) {
+		return nil, err
+	}
+	return []DamagedRange{{Path: s.path, StartKey: start, EndKey: s.maxKey, Err: err}}, nil
+}
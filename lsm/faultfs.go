@@ -0,0 +1,285 @@
+package lsm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrInjectedFault = errors.New("lsm: injected fault")
+
+// FaultFS wraps another FS and injects failures into it. It remembers how
+// much of every file it created has been synced so that Restart can simulate
+// a power loss by discarding everything written after the last Sync.
+type FaultFS struct {
+	base      FS
+	mutex     sync.Mutex
+	files     map[string]*faultState
+	failOn    func(op, name string) bool
+	tearAfter int64
+	crashed   bool
+}
+
+type faultState struct {
+	size   int64
+	synced int64
+}
+
+func NewFaultFS(base FS) *FaultFS {
+	return &FaultFS{
+		base:      fileSystem(base),
+		files:     make(map[string]*faultState),
+		tearAfter: -1,
+	}
+}
+
+func (f *FaultFS) FailOn(fn func(op, name string) bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failOn = fn
+}
+
+func (f *FaultFS) TearWritesAfter(n int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tearAfter = n
+}
+
+func (f *FaultFS) Crash() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.crashed = true
+}
+
+func (f *FaultFS) Restart() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for name, st := range f.files {
+		if st.synced == st.size {
+			continue
+		}
+		if err := f.truncateLocked(name, st.synced); err != nil {
+			return err
+		}
+		st.size = st.synced
+	}
+	f.failOn = nil
+	f.tearAfter = -1
+	f.crashed = false
+	return nil
+}
+
+func (f *FaultFS) truncateLocked(name string, size int64) error {
+	in, err := f.base.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(in, data)
+	_ = in.Close()
+	if err != nil {
+		return err
+	}
+	out, err := f.base.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (f *FaultFS) check(op, name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.checkLocked(op, name)
+}
+
+func (f *FaultFS) checkLocked(op, name string) error {
+	if f.crashed || (f.failOn != nil && f.failOn(op, name)) {
+		return &os.PathError{Op: op, Path: name, Err: ErrInjectedFault}
+	}
+	return nil
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	if err := f.check("create", name); err != nil {
+		return nil, err
+	}
+	file, err := f.base.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	st := &faultState{}
+	f.files[name] = st
+	return &faultFile{File: file, fs: f, name: name, state: st}, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	name = filepath.Clean(name)
+	if err := f.check("open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	if err := f.check("remove", name); err != nil {
+		return err
+	}
+	if err := f.base.Remove(name); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.files, name)
+	return nil
+}
+
+func (f *FaultFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	if err := f.check("rename", oldname); err != nil {
+		return err
+	}
+	if err := f.base.Rename(oldname, newname); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.files, newname)
+	if st, ok := f.files[oldname]; ok {
+		delete(f.files, oldname)
+		f.files[newname] = st
+	}
+	return nil
+}
+
+func (f *FaultFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	if err := f.check("link", newname); err != nil {
+		return err
+	}
+	if err := f.base.Link(oldname, newname); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if st, ok := f.files[oldname]; ok {
+		f.files[newname] = st
+	}
+	return nil
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.check("mkdir", path); err != nil {
+		return err
+	}
+	return f.base.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := f.check("readdir", name); err != nil {
+		return nil, err
+	}
+	return f.base.ReadDir(name)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.check("stat", name); err != nil {
+		return nil, err
+	}
+	return f.base.Stat(name)
+}
+
+func (f *FaultFS) SyncDir(name string) error {
+	if err := f.check("syncdir", name); err != nil {
+		return err
+	}
+	return f.base.SyncDir(name)
+}
+
+type faultFile struct {
+	File
+	fs    *FaultFS
+	name  string
+	state *faultState
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.check("read", f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.check("read", f.name); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.fs.checkLocked("write", f.name); err != nil {
+		return 0, err
+	}
+	var torn error
+	if f.fs.tearAfter >= 0 && int64(len(p)) > f.fs.tearAfter {
+		p = p[:f.fs.tearAfter]
+		torn = &os.PathError{Op: "write", Path: f.name, Err: ErrInjectedFault}
+	}
+	n, err := f.File.Write(p)
+	if f.fs.tearAfter >= 0 {
+		f.fs.tearAfter -= int64(n)
+	}
+	if f.state != nil {
+		f.state.size += int64(n)
+	}
+	if err == nil {
+		err = torn
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mutex.Lock()
+	err := f.fs.checkLocked("sync", f.name)
+	var size int64
+	if f.state != nil {
+		size = f.state.size
+	}
+	f.fs.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	if f.state != nil {
+		f.fs.mutex.Lock()
+		f.state.synced = max(f.state.synced, size)
+		f.fs.mutex.Unlock()
+	}
+	return nil
+}
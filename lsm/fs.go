@@ -0,0 +1,64 @@
+package lsm
+
+import (
+	"io"
+	"os"
+)
+
+// File is the subset of *os.File the LSM reads and writes through.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// FS is every file operation the LSM performs. Create truncates an existing
+// file and opens it for reading and writing; Open is read-only.
+type FS interface {
+	Create(name string) (File, error)
+	Open(name string) (File, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Link(oldname, newname string) error
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+	SyncDir(name string) error
+}
+
+type OSFS struct{}
+
+func (OSFS) Create(name string) (File, error) { return os.Create(name) }
+
+func (OSFS) Open(name string) (File, error) { return os.Open(name) }
+
+func (OSFS) Remove(name string) error { return os.Remove(name) }
+
+func (OSFS) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+
+func (OSFS) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error) { return os.ReadDir(name) }
+
+func (OSFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (OSFS) SyncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func fileSystem(fs FS) FS {
+	if fs == nil {
+		return OSFS{}
+	}
+	return fs
+}
@@ -0,0 +1,187 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	errIngestKeyOrder = errors.New("sstable: keys must be strictly increasing")
+	errIngestOverlap  = errors.New("lsm: ingested files overlap")
+)
+
+func (l *LSM) Ingest(paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	type ingestFile struct {
+		src, dst       string
+		minKey, maxKey string
+	}
+	files := make([]ingestFile, 0, len(paths))
+	for _, path := range paths {
+		minKey, maxKey, err := checkIngestFile(l.fs, path)
+		if err != nil {
+			return fmt.Errorf("lsm: ingest %s: %w", path, err)
+		}
+		files = append(files, ingestFile{src: path, minKey: minKey, maxKey: maxKey})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].minKey < files[j].minKey })
+	for i := 1; i < len(files); i++ {
+		if files[i].minKey <= files[i-1].maxKey {
+			return errIngestOverlap
+		}
+	}
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return ErrClosed
+	}
+	for i := range files {
+		files[i].dst = l.newFilePathLocked(0)
+	}
+	l.mutex.Unlock()
+
+	var tables []*SSTable
+	cleanup := func() {
+		for _, t := range tables {
+			_ = t.Close()
+		}
+		for _, f := range files {
+			_ = l.fs.Remove(f.dst)
+		}
+	}
+	for _, f := range files {
+		if err := l.fs.Link(f.src, f.dst); err != nil {
+			if err := copyFile(l.fs, f.src, f.dst); err != nil {
+				cleanup()
+				return err
+			}
+		}
+		t, err := openSSTable(f.dst, l.tableOpts)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		tables = append(tables, t)
+	}
+	if err := l.fs.SyncDir(l.dir); err != nil {
+		cleanup()
+		return err
+	}
+
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.waitForIngestLocked(tables); err != nil {
+		cleanup()
+		return err
+	}
+
+	seq := l.sequenceNumber
+	l.sequenceNumber++
+	var edit versionEdit
+	levels := make([]int, len(tables))
+	for i, t := range tables {
+		t.setGlobalSeq(seq)
+		levels[i] = l.ingestLevelLocked(t)
+		edit.added = append(edit.added, t.manifestTable(levels[i]))
+	}
+	if err := l.logEditLocked(edit); err != nil {
+		cleanup()
+		return err
+	}
+	for i, t := range tables {
+		l.ensureLevelLocked(levels[i])
+		l.files[levels[i]] = append(l.files[levels[i]], t)
+		if levels[i] > 0 {
+			sortByMinKey(l.files[levels[i]])
+		}
+	}
+	l.cond.Broadcast()
+	return nil
+}
+
+func checkIngestFile(fs FS, path string) (string, string, error) {
+	opts := defaultTableOptions()
+	opts.fs = fs
+	t, err := openSSTable(path, opts)
+	if err != nil {
+		return "", "", err
+	}
+	defer t.Close()
+	if t.version == sstFormatV1 {
+		return "", "", errors.New("sstable: legacy format cannot be ingested")
+	}
+	if t.keyCount == 0 {
+		return "", "", errors.New("sstable: empty table")
+	}
+	if len(t.valueFiles) > 0 {
+		return "", "", errors.New("sstable: table points into a value log")
+	}
+
+	it := t.newIterator(false)
+	count := 0
+	var last string
+	for it.first(); it.valid(); it.next() {
+		if count > 0 && it.key() <= last {
+			return "", "", errIngestKeyOrder
+		}
+		if _, err := it.value(); err != nil {
+			return "", "", err
+		}
+		last = it.key()
+		count++
+	}
+	if err := it.err(); err != nil {
+		return "", "", err
+	}
+	if count != t.keyCount {
+		return "", "", errIngestKeyOrder
+	}
+	return t.minKey, t.maxKey, nil
+}
+
+func (l *LSM) waitForIngestLocked(tables []*SSTable) error {
+	for {
+		switch {
+		case l.closed:
+			return ErrClosed
+		case l.bgErr != nil:
+			return l.bgErr
+		case memTableOverlaps(l.memTable, tables):
+			if err := l.rotateMemTableLocked(); err != nil {
+				return err
+			}
+		case len(l.immutables) > 0, l.flushing, l.runningCompactions > 0:
+			l.cond.Wait()
+		default:
+			return nil
+		}
+	}
+}
+
+func memTableOverlaps(m *MemTable, tables []*SSTable) bool {
+	for _, t := range tables {
+		it := m.newIterator(false)
+		it.seek(t.minKey)
+		if it.valid() && it.key() <= t.maxKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *LSM) ingestLevelLocked(t *SSTable) int {
+	level := 0
+	for i := 0; i < l.maxLevels; i++ {
+		if len(overlappingTables(l.levelFilesLocked(i), t.minKey, t.maxKey)) > 0 {
+			break
+		}
+		level = i
+	}
+	return level
+}
@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"path/filepath"
+	"time"
+)
+
+type TableInfo struct {
+	Path        string
+	Format      int
+	Size        uint64
+	KeyCount    int
+	MinKey      string
+	MaxKey      string
+	Blocks      int
+	BloomBits   uint64
+	BloomHashes uint32
+	GlobalSeq   uint32
+	Ingested    bool
+	ValueLogs   []string
+}
+
+type Entry struct {
+	Key       string
+	Value     *string
+	Kind      string
+	Sequence  uint32
+	ExpiresAt time.Time
+	ValueLog  string
+	ValueAt   uint64
+
+	pointer *valuePointer
+}
+
+func (k valueKind) String() string {
+	switch k {
+	case kindDelete:
+		return "delete"
+	case kindPut, kindPutExpiring, kindPutPointer:
+		return "put"
+	case kindMerge:
+		return "merge"
+	}
+	return "unknown"
+}
+
+func (s *SSTable) Info() TableInfo {
+	info := TableInfo{
+		Path:      s.path,
+		Format:    s.version,
+		Size:      s.size,
+		KeyCount:  s.keyCount,
+		MinKey:    s.minKey,
+		MaxKey:    s.maxKey,
+		Blocks:    len(s.blocks),
+		GlobalSeq: s.globalSeq,
+		Ingested:  s.hasGlobalSeq,
+	}
+	for _, id := range s.valueFiles {
+		info.ValueLogs = append(info.ValueLogs, valueLogName(id))
+	}
+	if s.bloom != nil {
+		info.BloomBits = s.bloom.mBits
+		info.BloomHashes = s.bloom.hashes
+	}
+	return info
+}
+
+func (s *SSTable) Scan(fn func(Entry) error) error {
+	it := s.newIterator(false)
+	for it.first(); it.valid(); it.next() {
+		v, err := it.value()
+		if err != nil {
+			return err
+		}
+		e := Entry{Key: it.key(), Value: v.value, Kind: v.kind.String(), Sequence: v.sequenceNumber}
+		if v.expiresAt != 0 {
+			e.ExpiresAt = time.Unix(0, v.expiresAt)
+		}
+		if v.pointer != nil {
+			e.ValueLog = valueLogName(v.pointer.fileID)
+			e.ValueAt = v.pointer.offset
+			e.pointer = v.pointer
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return it.err()
+}
+
+// ResolveValue reads the value of an entry stored in a value log from the
+// log next to the table. Entries stored inline are left unchanged.
+func (s *SSTable) ResolveValue(e *Entry) error {
+	if e.pointer == nil || e.Value != nil {
+		return nil
+	}
+	if s.valueLog != nil {
+		value, err := s.valueLog.read(*e.pointer)
+		if err != nil {
+			return err
+		}
+		e.Value = &value
+		return nil
+	}
+	path := filepath.Join(filepath.Dir(s.path), e.ValueLog)
+	f, err := s.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	value, err := readValueAt(f, path, *e.pointer)
+	if err != nil {
+		return err
+	}
+	e.Value = &value
+	return nil
+}
+
+func OpenTables(dir string) ([][]*SSTable, error) {
+	state, err := readManifest(OSFS{}, dir)
+	if err == nil && !state.found {
+		state, err = scanTableFiles(OSFS{}, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	levels := make([][]*SSTable, len(state.levels))
+	for level, names := range state.levels {
+		for _, name := range names {
+			t, err := OpenSSTable(filepath.Join(dir, name))
+			if err != nil {
+				for _, tables := range levels {
+					for _, t := range tables {
+						_ = t.Close()
+					}
+				}
+				return nil, err
+			}
+			if seq, ok := state.globalSeqs[name]; ok {
+				t.setGlobalSeq(seq)
+			}
+			levels[level] = append(levels[level], t)
+		}
+		if level > 0 {
+			sortByMinKey(levels[level])
+		}
+	}
+	return levels, nil
+}
@@ -0,0 +1,221 @@
+package lsm
+
+type internalIterator interface {
+	first()
+	seek(key string)
+	next()
+	valid() bool
+	key() string
+	value() (VersionedValue, error)
+	err() error
+}
+
+type Iterator struct {
+	op      MergeOperator
+	values  *valueLog
+	sources []internalIterator
+	tables  []*SSTable
+	reverse bool
+	lower   string
+	upper   string
+	seq     uint32
+
+	curKey   string
+	curValue string
+	ok       bool
+	lastErr  error
+}
+
+func (l *LSM) Range(start, end string, reverse bool) *Iterator {
+	it := l.newIterator(start, end, reverse, latestSequence)
+	it.rewind()
+	return it
+}
+
+func (l *LSM) Prefix(prefix string, reverse bool) *Iterator {
+	return l.Range(prefix, prefixSuccessor(prefix), reverse)
+}
+
+func (l *LSM) newIterator(lower, upper string, reverse bool, seq uint32) *Iterator {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if seq == latestSequence {
+		seq = l.sequenceNumber
+	}
+
+	it := &Iterator{
+		op:      l.mergeOperator,
+		values:  l.values,
+		reverse: reverse,
+		lower:   lower,
+		upper:   upper,
+		seq:     seq,
+	}
+	it.sources = append(it.sources, l.memTable.newIterator(reverse))
+	for i := len(l.immutables) - 1; i >= 0; i-- {
+		it.sources = append(it.sources, l.immutables[i].table.newIterator(reverse))
+	}
+	for _, level := range l.files {
+		for i := len(level) - 1; i >= 0; i-- {
+			t := level[i]
+			t.acquire()
+			it.tables = append(it.tables, t)
+			it.sources = append(it.sources, t.newIterator(reverse))
+		}
+	}
+	return it
+}
+
+func (it *Iterator) rewind() {
+	if it.reverse {
+		if it.upper == "" {
+			for _, s := range it.sources {
+				s.first()
+			}
+		} else {
+			for _, s := range it.sources {
+				s.seek(it.upper)
+			}
+		}
+	} else {
+		for _, s := range it.sources {
+			s.seek(it.lower)
+		}
+	}
+	it.advance()
+}
+
+func (it *Iterator) Seek(key string) {
+	if it.reverse {
+		if it.upper != "" && key >= it.upper {
+			it.rewind()
+			return
+		}
+	} else if key < it.lower {
+		key = it.lower
+	}
+	for _, s := range it.sources {
+		s.seek(key)
+	}
+	it.advance()
+}
+
+func (it *Iterator) Next() {
+	if it.ok {
+		it.advance()
+	}
+}
+
+func (it *Iterator) Valid() bool { return it.ok }
+
+func (it *Iterator) Key() string { return it.curKey }
+
+func (it *Iterator) Value() string { return it.curValue }
+
+func (it *Iterator) Err() error { return it.lastErr }
+
+func (it *Iterator) Close() error {
+	for _, t := range it.tables {
+		t.release()
+	}
+	it.tables = nil
+	it.sources = nil
+	it.ok = false
+	return it.lastErr
+}
+
+func (it *Iterator) advance() {
+	it.ok = false
+	for it.lastErr == nil {
+		key, found := it.nextKey()
+		if !found {
+			return
+		}
+
+		var versions []VersionedValue
+		for _, s := range it.sources {
+			for s.valid() && s.key() == key {
+				v, err := s.value()
+				if err != nil {
+					it.lastErr = err
+					return
+				}
+				if v.sequenceNumber < it.seq {
+					versions = append(versions, v)
+				}
+				s.next()
+			}
+		}
+		if err := it.sourceErr(); err != nil {
+			it.lastErr = err
+			return
+		}
+
+		if it.reverse {
+			if key < it.lower {
+				return
+			}
+			if it.upper != "" && key >= it.upper {
+				continue
+			}
+		} else if it.upper != "" && key >= it.upper {
+			return
+		}
+		if len(versions) == 0 {
+			continue
+		}
+
+		if err := it.values.resolveNewest(versions); err != nil {
+			it.lastErr = err
+			return
+		}
+		v, err := resolveVersions(key, versions, it.op, true)
+		if err != nil {
+			it.lastErr = err
+			return
+		}
+		if v.kind == kindDelete {
+			continue
+		}
+		it.curKey = key
+		it.curValue = *v.value
+		it.ok = true
+		return
+	}
+}
+
+func (it *Iterator) nextKey() (string, bool) {
+	var key string
+	found := false
+	for _, s := range it.sources {
+		if !s.valid() {
+			continue
+		}
+		k := s.key()
+		if !found || (!it.reverse && k < key) || (it.reverse && k > key) {
+			key = k
+			found = true
+		}
+	}
+	return key, found
+}
+
+func (it *Iterator) sourceErr() error {
+	for _, s := range it.sources {
+		if err := s.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prefixSuccessor(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -2,113 +2,374 @@ package lsm
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 type LSM struct {
-	maxSize          int
-	dir              string
-	maxFilesPerLevel int
+	maxSize             int
+	dir                 string
+	maxFilesPerLevel    int
+	baseLevelBytes      uint64
+	levelSizeMultiplier uint64
+	targetFileSize      uint64
+	maxLevels           int
+	mergeOperator       MergeOperator
+	compactionFilter    CompactionFilter
+	tableOpts           tableOptions
+	bloomBitsPerLevel   []float64
+	values              *valueLog
+	fs                  FS
 
 	memTable       *MemTable
-	constMemTable  *MemTable
+	immutables     []*immutableMemTable
 	files          [][]*SSTable
 	sequenceNumber uint32
 	nextFileID     uint64
+	flushedWAL     uint64
 
-	mutex      sync.RWMutex
-	compacting bool
+	wal      *wal
+	manifest *manifest
+
+	compactPointers []string
+	snapshots       []uint32
+
+	maxImmutables              int
+	maxSubcompactions          int
+	l0SlowdownWritesTrigger    int
+	l0StopWritesTrigger        int
+	softPendingCompactionBytes uint64
+	hardPendingCompactionBytes uint64
+	onBackgroundError          func(error)
+
+	mutex              sync.RWMutex
+	writeMutex         sync.Mutex
+	cond               *sync.Cond
+	workers            sync.WaitGroup
+	flushing           bool
+	runningCompactions int
+	bgErr              error
+	closed             bool
+
+	metrics metrics
 }
 
 func Init(maxSize int) *LSM {
-	return &LSM{
-		maxSize:          maxSize,
-		dir:              "lsmdata",
-		maxFilesPerLevel: 6,
-		memTable:         NewMemTable(),
-	}
+	opts := DefaultOptions()
+	opts.MaxSize = maxSize
+	l := newLSM("lsmdata", opts)
+	l.startWorkers(opts.CompactionWorkers)
+	return l
 }
 
+// InitWithDir opens dir with default options and the given memtable size.
+// It panics if the directory cannot be opened; use Open to handle the error.
 func InitWithDir(maxSize int, dir string) *LSM {
-	l := Init(maxSize)
-	l.dir = dir
+	opts := DefaultOptions()
+	opts.MaxSize = maxSize
+	l, err := Open(dir, opts)
+	if err != nil {
+		panic(fmt.Sprintf("lsm: open %s: %v", dir, err))
+	}
 	return l
 }
 
-func (l *LSM) Put(key string, value *string) {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	seq := l.sequenceNumber
-	l.sequenceNumber++
+func Open(dir string, opts Options) (*LSM, error) {
+	fs := fileSystem(opts.FS)
+	if err := fs.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := newLSM(dir, opts)
+
+	state, err := readManifest(fs, dir)
+	if err == nil && !state.found {
+		state, err = scanTableFiles(fs, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool)
+	for level, names := range state.levels {
+		l.ensureLevelLocked(level)
+		for _, name := range names {
+			t, err := openSSTable(filepath.Join(dir, name), l.tableOpts)
+			if err != nil {
+				l.closeTablesLocked()
+				return nil, err
+			}
+			if seq, ok := state.globalSeqs[name]; ok {
+				t.setGlobalSeq(seq)
+			}
+			l.files[level] = append(l.files[level], t)
+			live[name] = true
+		}
+		if level > 0 && state.found {
+			sortByMinKey(l.files[level])
+		}
+	}
+	l.nextFileID = state.nextFileID
+	l.sequenceNumber = state.sequenceNumber
+	l.flushedWAL = state.flushedWAL
+	if !state.found {
+		live = nil
+		if err := l.adoptTablesLocked(); err != nil {
+			l.closeTablesLocked()
+			return nil, err
+		}
+	}
+
+	if err := removeStrayFiles(fs, dir, live); err != nil {
+		l.closeTablesLocked()
+		return nil, err
+	}
+	if err := l.values.removeUnreferenced(); err != nil {
+		l.closeTablesLocked()
+		return nil, err
+	}
+	m, err := createManifest(fs, dir, l.snapshotEditLocked())
+	if err != nil {
+		l.closeTablesLocked()
+		return nil, err
+	}
+	l.manifest = m
+
+	w, err := openWAL(fs, dir, opts.Sync, opts.SyncInterval, l.flushedWAL, func(key string, v VersionedValue) error {
+		if v.sequenceNumber >= l.sequenceNumber {
+			l.sequenceNumber = v.sequenceNumber + 1
+		}
+		return l.memTable.apply(key, v, l.mergeOperator)
+	})
+	if err != nil {
+		l.closeTablesLocked()
+		_ = m.close()
+		return nil, err
+	}
+	w.onSyncError = func(err error) {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.setBackgroundErrorLocked(err)
+	}
+	l.wal = w
+	l.startWorkers(opts.CompactionWorkers)
+	return l, nil
+}
+
+func newLSM(dir string, opts Options) *LSM {
+	l := &LSM{
+		maxSize:             opts.MaxSize,
+		dir:                 dir,
+		maxFilesPerLevel:    opts.MaxFilesPerLevel,
+		baseLevelBytes:      opts.BaseLevelBytes,
+		levelSizeMultiplier: opts.LevelSizeMultiplier,
+		targetFileSize:      opts.TargetFileSize,
+		maxLevels:           opts.MaxLevels,
+		mergeOperator:       opts.MergeOperator,
+		compactionFilter:    opts.CompactionFilter,
+		fs:                  fileSystem(opts.FS),
+		memTable:            NewMemTable(),
+		tableOpts: tableOptions{
+			blockSize:       opts.BlockSize,
+			compression:     opts.Compression,
+			bloomBitsPerKey: opts.Bloom.bitsPerKey(),
+			bloomCounters:   &bloomCounters{},
+			mmap:            opts.MmapReads,
+		},
+
+		maxImmutables:              max(opts.MaxImmutableMemTables, 1),
+		maxSubcompactions:          max(opts.MaxSubcompactions, 1),
+		l0SlowdownWritesTrigger:    opts.L0SlowdownWritesTrigger,
+		l0StopWritesTrigger:        opts.L0StopWritesTrigger,
+		softPendingCompactionBytes: opts.SoftPendingCompactionBytes,
+		hardPendingCompactionBytes: opts.HardPendingCompactionBytes,
+		onBackgroundError:          opts.OnBackgroundError,
+	}
+	l.cond = sync.NewCond(&l.mutex)
+	if opts.ValueLogFileSize <= 0 {
+		opts.ValueLogFileSize = DefaultOptions().ValueLogFileSize
+	}
+	l.tableOpts.fs = l.fs
+	l.values = newValueLog(l.fs, dir, opts.ValueLogThreshold, opts.ValueLogFileSize, func() uint64 {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return l.allocFileIDLocked()
+	})
+	l.tableOpts.valueLog = l.values
+	if l.tableOpts.blockSize <= 0 {
+		l.tableOpts.blockSize = defaultBlockSize
+	}
+	if opts.BlockCacheBytes > 0 {
+		l.tableOpts.cache = NewBlockCache(opts.BlockCacheBytes)
+	}
+	if opts.MaxOpenTables > 0 {
+		l.tableOpts.tableCache = NewTableCache(opts.MaxOpenTables)
+	}
+	if l.mergeOperator == nil {
+		l.mergeOperator = LastWriteWins{}
+	}
+	if l.maxLevels < 2 {
+		l.maxLevels = 2
+	}
+	if l.tableOpts.bloomBitsPerKey <= 0 {
+		l.tableOpts.bloomBitsPerKey = defaultBloomBitsPerKey
+	}
+	for _, p := range opts.BloomPerLevel {
+		bits := p.bitsPerKey()
+		if bits <= 0 {
+			bits = l.tableOpts.bloomBitsPerKey
+		}
+		l.bloomBitsPerLevel = append(l.bloomBitsPerLevel, bits)
+	}
+	if l.levelSizeMultiplier < 1 {
+		l.levelSizeMultiplier = 1
+	}
+	if l.maxFilesPerLevel < 1 {
+		l.maxFilesPerLevel = 1
+	}
+	if l.targetFileSize == 0 {
+		l.targetFileSize = DefaultOptions().TargetFileSize
+	}
+	if l.baseLevelBytes == 0 {
+		l.baseLevelBytes = DefaultOptions().BaseLevelBytes
+	}
+	if l.l0StopWritesTrigger <= l.maxFilesPerLevel {
+		l.l0StopWritesTrigger = l.maxFilesPerLevel + 1
+	}
+	if l.l0SlowdownWritesTrigger <= l.maxFilesPerLevel {
+		l.l0SlowdownWritesTrigger = l.l0StopWritesTrigger
+	}
+	return l
+}
 
-	l.memTable.Put(key, value, seq)
-	if l.maxSize < l.memTable.Size() && !l.compacting {
-		l.compacting = true
-		go l.Compact()
+func (l *LSM) Put(key string, value *string) error {
+	kind := kindPut
+	if value == nil {
+		kind = kindDelete
 	}
+	return l.write(key, VersionedValue{value: value, kind: kind})
+}
+
+func (l *LSM) Delete(key string) error {
+	return l.Put(key, nil)
+}
+
+func (l *LSM) PutWithTTL(key string, value string, ttl time.Duration) error {
+	return l.write(key, VersionedValue{value: &value, kind: kindPut, expiresAt: expiryAfter(ttl)})
+}
+
+func (l *LSM) Merge(key string, operand string) error {
+	return l.write(key, VersionedValue{value: &operand, kind: kindMerge})
+}
+
+func (l *LSM) write(key string, v VersionedValue) error {
+	return l.Write(&WriteBatch{entries: []batchEntry{{key: key, value: v}}})
 }
 
 func (l *LSM) Get(key string) *string {
+	v, _ := l.GetErr(key)
+	return v
+}
+
+func (l *LSM) GetErr(key string) (*string, error) {
+	v, _, err := l.lookup(key, latestSequence)
+	return v.value, err
+}
+
+func (l *LSM) lookup(key string, seq uint32) (VersionedValue, bool, error) {
+	start := time.Now()
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
-	if v, ok := l.memTable.Get(key); ok {
-		return v.value
+	if seq == latestSequence {
+		seq = l.sequenceNumber
+	}
+
+	var versions []VersionedValue
+	probed, err := l.forEachVersionLocked(key, func(v VersionedValue) bool {
+		if v.sequenceNumber >= seq {
+			return true
+		}
+		versions = append(versions, v)
+		return v.kind == kindMerge
+	})
+	l.metrics.recordGet(start, probed)
+	if err != nil {
+		return VersionedValue{}, false, err
+	}
+	if len(versions) == 0 {
+		return VersionedValue{}, false, nil
 	}
-	if l.constMemTable != nil {
-		if v, ok := l.constMemTable.Get(key); ok {
-			return v.value
+	if err := l.values.resolveNewest(versions); err != nil {
+		return VersionedValue{}, false, err
+	}
+	v, err := resolveVersions(key, versions, l.mergeOperator, true)
+	if err != nil {
+		return VersionedValue{}, false, err
+	}
+	return v, true, nil
+}
+
+func (l *LSM) forEachVersionLocked(key string, fn func(v VersionedValue) bool) (probed int, err error) {
+	visit := func(versions []VersionedValue) bool {
+		for _, v := range versions {
+			if !fn(v) {
+				return false
+			}
+		}
+		return true
+	}
+	if !visit(l.memTable.versions(key)) {
+		return probed, nil
+	}
+	for i := len(l.immutables) - 1; i >= 0; i-- {
+		if !visit(l.immutables[i].table.versions(key)) {
+			return probed, nil
 		}
 	}
 
-	for _, level := range l.files {
-		for i := len(level) - 1; i >= 0; i-- {
-			f := level[i]
+	for level, tables := range l.files {
+		if level > 0 {
+			f := findTableForKey(tables, key)
+			if f == nil {
+				continue
+			}
+			probed++
+			versions, err := f.getVersions(key)
+			if err != nil {
+				return probed, err
+			}
+			if !visit(versions) {
+				return probed, nil
+			}
+			continue
+		}
+		for i := len(tables) - 1; i >= 0; i-- {
+			f := tables[i]
 			if f.keyCount > 0 && (key < f.minKey || key > f.maxKey) {
 				continue
 			}
-			v, ok, err := f.Get(key)
-			if err == nil && ok {
-				return v.value
+			probed++
+			versions, err := f.getVersions(key)
+			if err != nil {
+				return probed, err
+			}
+			if !visit(versions) {
+				return probed, nil
 			}
 		}
 	}
-
-	return nil
+	return probed, nil
 }
 
-func (l *LSM) Compact() error {
-	l.mutex.Lock()
-	if l.memTable.Size() == 0 {
-		l.compacting = false
-		l.mutex.Unlock()
-		return nil
-	}
-
-	l.constMemTable = l.memTable
-	l.memTable = NewMemTable()
-	snapshot := l.constMemTable
-
-	path := l.newFilePathLocked(0)
-	l.mutex.Unlock()
-
-	sst, err := CreateSSTableFromMemTable(path, snapshot)
-	if err != nil {
-		l.mutex.Lock()
-		l.compacting = false
-		l.mutex.Unlock()
-		return err
+func (l *LSM) tableOptsForLevel(level int) tableOptions {
+	opts := l.tableOpts
+	if level < len(l.bloomBitsPerLevel) {
+		opts.bloomBitsPerKey = l.bloomBitsPerLevel[level]
 	}
+	return opts
+}
 
-	l.mutex.Lock()
-	l.constMemTable = nil
-	l.ensureLevelLocked(0)
-	l.files[0] = append(l.files[0], sst)
-	err = l.maybeCompactLevelsLocked()
-	l.compacting = false
-	l.mutex.Unlock()
-	return err
+func (l *LSM) BloomStats() BloomStats {
+	return l.tableOpts.bloomCounters.stats()
 }
 
 func (l *LSM) ensureLevelLocked(level int) {
@@ -117,36 +378,41 @@ func (l *LSM) ensureLevelLocked(level int) {
 	}
 }
 
-func (l *LSM) newFilePathLocked(level int) string {
+func (l *LSM) allocFileIDLocked() uint64 {
 	id := l.nextFileID
 	l.nextFileID++
-	name := fmt.Sprintf("L%d-%d.sst", level, id)
-	return filepath.Join(l.dir, name)
+	return id
 }
 
-func (l *LSM) maybeCompactLevelsLocked() error {
-	for level := 0; level < len(l.files); level++ {
-		if len(l.files[level]) <= l.maxFilesPerLevel {
-			continue
-		}
+func (l *LSM) newFilePathLocked(level int) string {
+	name := fmt.Sprintf("L%d-%d.sst", level, l.allocFileIDLocked())
+	return filepath.Join(l.dir, name)
+}
 
-		nextLevel := level + 1
-		l.ensureLevelLocked(nextLevel)
-		tables := append([]*SSTable(nil), l.files[level]...)
+func (l *LSM) logEditLocked(e versionEdit) error {
+	if l.manifest == nil {
+		return nil
+	}
+	e.nextFileID = l.nextFileID
+	e.sequenceNumber = l.sequenceNumber
+	e.flushedWAL = l.flushedWAL
+	return l.manifest.logEdit(e)
+}
 
-		outPath := l.newFilePathLocked(nextLevel)
-		merged, err := MergeSSTables(outPath, tables...)
-		if err != nil {
-			return err
+func (l *LSM) snapshotEditLocked() versionEdit {
+	e := versionEdit{nextFileID: l.nextFileID, sequenceNumber: l.sequenceNumber, flushedWAL: l.flushedWAL}
+	for level, tables := range l.files {
+		for _, t := range tables {
+			e.added = append(e.added, t.manifestTable(level))
 		}
+	}
+	return e
+}
 
-		for _, t := range tables {
+func (l *LSM) closeTablesLocked() {
+	for _, level := range l.files {
+		for _, t := range level {
 			t.Close()
-			os.Remove(t.Path())
 		}
-
-		l.files[level] = nil
-		l.files[nextLevel] = append(l.files[nextLevel], merged)
 	}
-	return nil
 }
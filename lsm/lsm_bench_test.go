@@ -1,8 +1,14 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
+	"math/rand"
+	"path/filepath"
 	"testing"
+
+	"github.com/RoaringBitmap/roaring/v2"
 )
 
 func BenchmarkLSPut(b *testing.B) {
@@ -22,6 +28,7 @@ func BenchmarkLSPut(b *testing.B) {
 				for _, k := range keys {
 					l.Put(k, &v)
 				}
+				l.Close()
 			}
 		})
 	}
@@ -30,22 +37,96 @@ func BenchmarkLSPut(b *testing.B) {
 func BenchmarkLSMGet(b *testing.B) {
 	sizes := []int{10, 100, 1_000, 10_000, 100_000, 1_000_000}
 
-	for _, n := range sizes {
-		b.Run(fmt.Sprintf("N=%d", n), func(b *testing.B) {
-			keys := make([]string, n)
-			for i := 0; i < n; i++ {
-				keys[i] = fmt.Sprintf("%d", i)
+	for _, mmap := range []bool{false, true} {
+		for _, n := range sizes {
+			b.Run(fmt.Sprintf("mmap=%v/N=%d", mmap, n), func(b *testing.B) {
+				keys := make([]string, n)
+				for i := 0; i < n; i++ {
+					keys[i] = fmt.Sprintf("%d", i)
+				}
+				v := "v"
+				opts := DefaultOptions()
+				opts.MaxSize = 1000
+				opts.BlockCacheBytes = 0
+				opts.MmapReads = mmap
+				l, err := Open(b.TempDir(), opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer l.Close()
+				for _, k := range keys {
+					l.Put(k, &v)
+				}
+				if err := l.Compact(); err != nil {
+					b.Fatal(err)
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = l.Get(keys[i%len(keys)])
+				}
+			})
+		}
+	}
+}
+
+func indexPostings(docs, docLen, vocab int) *MemTable {
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, 1.1, 1, uint64(vocab-1))
+	positional := make(map[string]map[uint32][]uint32)
+	bitmaps := make(map[string]*roaring.Bitmap)
+	for doc := 0; doc < docs; doc++ {
+		for pos := 0; pos < docLen; pos++ {
+			term := fmt.Sprintf("t%05d", zipf.Uint64())
+			p := positional[term]
+			if p == nil {
+				p = make(map[uint32][]uint32)
+				positional[term] = p
+				bitmaps[term] = roaring.New()
 			}
-			v := "v"
-			l := Init(1000)
-			for _, k := range keys {
-				l.Put(k, &v)
+			p[uint32(doc)] = append(p[uint32(doc)], uint32(pos))
+			bitmaps[term].Add(uint32(doc))
+		}
+	}
+
+	mem := NewMemTable()
+	var seq uint32
+	for term, p := range positional {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+			panic(err)
+		}
+		posting := buf.String()
+		mem.Put("pos:"+term, &posting, seq)
+		data, err := bitmaps[term].ToBytes()
+		if err != nil {
+			panic(err)
+		}
+		bitmap := string(data)
+		mem.Put("doc:"+term, &bitmap, seq+1)
+		seq += 2
+	}
+	return mem
+}
+
+func BenchmarkBlockCompression(b *testing.B) {
+	mem := indexPostings(2_000, 200, 5_000)
+	entries := mem.SortedEntries()
+	for _, c := range []Compression{CompressionNone, CompressionFlate, CompressionSnappy} {
+		b.Run(c.String(), func(b *testing.B) {
+			sst, err := createSSTable(filepath.Join(b.TempDir(), "postings.sst"), mem, tableOptions{blockSize: defaultBlockSize, compression: c})
+			if err != nil {
+				b.Fatal(err)
 			}
+			defer sst.Close()
 
 			b.ResetTimer()
 			for i := 0; i < b.N; i++ {
-				_ = l.Get(keys[i%len(keys)])
+				if _, _, err := sst.Get(entries[i%len(entries)].Key); err != nil {
+					b.Fatal(err)
+				}
 			}
+			b.ReportMetric(float64(sst.size), "file-bytes")
 		})
 	}
 }
@@ -0,0 +1,2926 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/v2"
+)
+
+func openTestLSM(t *testing.T, dir string, maxSize int) *LSM {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.MaxSize = maxSize
+	opts.Sync = SyncEveryWrite
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return l
+}
+
+func strPtr(s string) *string { return &s }
+
+func bitmapValue(ids ...uint32) *string {
+	data, err := roaring.BitmapOf(ids...).ToBytes()
+	if err != nil {
+		panic(err)
+	}
+	s := string(data)
+	return &s
+}
+
+func TestWALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, 1024)
+	for _, k := range []string{"a", "b", "c"} {
+		if err := l.Put(k, strPtr("v"+k)); err != nil {
+			t.Fatalf("Put(%q): %v", k, err)
+		}
+	}
+
+	reopened := openTestLSM(t, dir, 1024)
+	for _, k := range []string{"a", "b", "c"} {
+		got := reopened.Get(k)
+		if got == nil || *got != "v"+k {
+			t.Fatalf("Get(%q) after reopen = %v, want %q", k, got, "v"+k)
+		}
+	}
+	if err := reopened.Put("d", strPtr("vd")); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.sequenceNumber != 4 {
+		t.Fatalf("sequenceNumber = %d, want 4", reopened.sequenceNumber)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, 1024)
+	if err := l.Put("a", strPtr("va")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("b", strPtr("vb")); err != nil {
+		t.Fatal(err)
+	}
+
+	path := walPath(dir, l.wal.id)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, st.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestLSM(t, dir, 1024)
+	if got := reopened.Get("a"); got == nil || *got != "va" {
+		t.Fatalf("Get(a) = %v, want va", got)
+	}
+	if got := reopened.Get("b"); got != nil {
+		t.Fatalf("Get(b) = %q, want torn record dropped", *got)
+	}
+}
+
+func TestWALGroupedSyncBoundsUnsyncedWrites(t *testing.T) {
+	mem := NewMemFS()
+	ffs := NewFaultFS(mem)
+	opts := DefaultOptions()
+	opts.FS = ffs
+	opts.Sync = SyncGrouped
+	opts.SyncInterval = 20 * time.Millisecond
+	l, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := l.Put(k, strPtr("v"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	ffs.Crash()
+	_ = l.Close()
+	if err := ffs.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if got := reopened.Get(k); got == nil || *got != "v"+k {
+			t.Fatalf("Get(%q) after power loss = %v, want synced by the grouped-sync timer", k, got)
+		}
+	}
+}
+
+func TestWALTruncatedAfterFlush(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, 1024)
+	if err := l.Put("a", strPtr("va")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	ids, err := listWALSegments(OSFS{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != l.wal.id {
+		t.Fatalf("WAL segments after flush = %v, want only active %d", ids, l.wal.id)
+	}
+	if got := l.Get("a"); got == nil || *got != "va" {
+		t.Fatalf("Get(a) after flush = %v, want va", got)
+	}
+}
+
+func TestReopenRestoresManifest(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 2
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := l.Put(key, bitmapValue(uint32(i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+	}
+	want := layoutOf(l)
+
+	if err := os.WriteFile(filepath.Join(dir, "sst-123.tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "L1-99.sst"), []byte("orphan"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := layoutOf(reopened); !reflect.DeepEqual(got, want) {
+		t.Fatalf("layout after reopen = %v, want %v", got, want)
+	}
+	if reopened.nextFileID != l.nextFileID {
+		t.Fatalf("nextFileID = %d, want %d", reopened.nextFileID, l.nextFileID)
+	}
+	if reopened.sequenceNumber != l.sequenceNumber {
+		t.Fatalf("sequenceNumber = %d, want %d", reopened.sequenceNumber, l.sequenceNumber)
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if got := reopened.Get(key); got == nil || *got != *bitmapValue(uint32(i)) {
+			t.Fatalf("Get(%q) = %v, want bitmap {%d}", key, got, i)
+		}
+	}
+	for _, name := range []string{"sst-123.tmp", "L1-99.sst"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("stray file %s not removed: %v", name, err)
+		}
+	}
+}
+
+func TestDamagedManifestFailsOpen(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, 1<<20)
+	for i := 0; i < 3; i++ {
+		if err := l.Put(fmt.Sprintf("k%d", i), strPtr("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, manifestFileName)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, st.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	torn := openTestLSM(t, dir, 1<<20)
+	if got := torn.Get("k0"); got == nil {
+		t.Fatal("torn final manifest record lost earlier tables")
+	}
+	want := layoutOf(torn)
+	if err := torn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	flipByte(t, path, logRecordHeaderSize+2)
+	if _, err := Open(dir, DefaultOptions()); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Open with a damaged manifest = %v, want ErrCorruption", err)
+	}
+	for _, names := range want {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Fatalf("table %s removed after a damaged manifest: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestOpenWithoutManifestAdoptsTables(t *testing.T) {
+	dir := t.TempDir()
+	seq := uint32(0)
+	for _, f := range []struct {
+		name string
+		kvs  []string
+	}{
+		{"L2-0.sst", []string{"z", "z0"}},
+		{"L1-1.sst", []string{"a", "a1", "c", "c1"}},
+		{"L1-2.sst", []string{"a", "a2"}},
+		{"L0-3.sst", []string{"b", "b3"}},
+		{"L0-4.sst", []string{"a", "a4"}},
+	} {
+		table := NewMemTable()
+		for i := 0; i < len(f.kvs); i += 2 {
+			table.Put(f.kvs[i], strPtr(f.kvs[i+1]), seq)
+			seq++
+		}
+		writeV1Table(t, filepath.Join(dir, f.name), table)
+	}
+
+	l := openTestLSM(t, dir, 1<<20)
+	want := [][]string{{"L1-1.sst", "L1-2.sst", "L0-3.sst", "L0-4.sst"}, nil, {"L2-0.sst"}}
+	if got := layoutOf(l); !reflect.DeepEqual(got, want) {
+		t.Fatalf("layout = %v, want %v", got, want)
+	}
+	if l.nextFileID != 5 || l.sequenceNumber != seq {
+		t.Fatalf("nextFileID = %d, sequenceNumber = %d; want 5, %d", l.nextFileID, l.sequenceNumber, seq)
+	}
+	for key, want := range map[string]string{"a": "a4", "b": "b3", "c": "c1", "z": "z0"} {
+		if got := l.Get(key); got == nil || *got != want {
+			t.Fatalf("Get(%q) = %v, want %s", key, got, want)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestLSM(t, dir, 1<<20)
+	defer reopened.Close()
+	if got := layoutOf(reopened); !reflect.DeepEqual(got, want) {
+		t.Fatalf("layout after manifest reopen = %v, want %v", got, want)
+	}
+	if got := reopened.Get("a"); got == nil || *got != "a4" {
+		t.Fatalf("Get(a) after manifest reopen = %v, want a4", got)
+	}
+}
+
+func layoutOf(l *LSM) [][]string {
+	out := make([][]string, len(l.files))
+	for level, tables := range l.files {
+		for _, t := range tables {
+			out[level] = append(out[level], filepath.Base(t.Path()))
+		}
+	}
+	return out
+}
+
+func TestDeleteShadowsOlderTables(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, 1024)
+	if err := l.Put("k", bitmapValue(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("k"); got != nil {
+		t.Fatalf("Get after Delete = %v, want nil", got)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("k"); got != nil {
+		t.Fatalf("Get after flushing tombstone = %v, want nil", got)
+	}
+	if got := openTestLSM(t, dir, 1024).Get("k"); got != nil {
+		t.Fatalf("Get after reopen = %v, want nil", got)
+	}
+}
+
+func TestMergeKeepsTombstones(t *testing.T) {
+	dir := t.TempDir()
+	older := NewMemTable()
+	older.Put("k", bitmapValue(1), 1)
+	newer := NewMemTable()
+	newer.Put("k", nil, 2)
+
+	a, err := CreateSSTableFromMemTable(filepath.Join(dir, "a.sst"), older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := CreateSSTableFromMemTable(filepath.Join(dir, "b.sst"), newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, err := MergeSSTables(filepath.Join(dir, "kept.sst"), LastWriteWins{}, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok, err := kept.Get("k")
+	if err != nil || !ok || v.value != nil || v.sequenceNumber != 2 {
+		t.Fatalf("merged Get = %+v, %v, %v; want tombstone at seq 2", v, ok, err)
+	}
+
+	dropped, err := mergeSSTables(filepath.Join(dir, "bottom.sst"), defaultTableOptions(), mergePolicy{op: LastWriteWins{}, bottom: true}, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := dropped.Get("k"); err != nil || ok {
+		t.Fatalf("bottom-level merge kept key: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestMergeOperator(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Sync = SyncEveryWrite
+	opts.MaxFilesPerLevel = 1
+	opts.MergeOperator = RoaringUnion{}
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Merge("k", *bitmapValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Merge("k", *bitmapValue(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("k"); got == nil || *got != *bitmapValue(1, 2) {
+		t.Fatalf("Get after merges across a flush = %v, want {1,2}", got)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("k"); got == nil || *got != *bitmapValue(1, 2) {
+		t.Fatalf("Get after compaction = %v, want {1,2}", got)
+	}
+
+	if err := l.Put("k", bitmapValue(7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Merge("k", *bitmapValue(8)); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("k"); got == nil || *got != *bitmapValue(7, 8) {
+		t.Fatalf("Get after Put+Merge = %v, want {7,8}", got)
+	}
+
+	if err := l.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Merge("k", *bitmapValue(9)); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Get("k"); got == nil || *got != *bitmapValue(9) {
+		t.Fatalf("Get after Delete+Merge and reopen = %v, want {9}", got)
+	}
+}
+
+func TestPutOverwritesBitmaps(t *testing.T) {
+	l := openTestLSM(t, t.TempDir(), 1024)
+	if err := l.Put("k", bitmapValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("k", bitmapValue(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("k"); got == nil || *got != *bitmapValue(2) {
+		t.Fatalf("Get = %v, want {2}", got)
+	}
+}
+
+func collect(it *Iterator) []string {
+	var out []string
+	for ; it.Valid(); it.Next() {
+		out = append(out, it.Key()+"="+it.Value())
+	}
+	return out
+}
+
+func TestIterator(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	l, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"apple", "apricot", "banana", "blueberry", "cherry"} {
+		if err := l.Put(k, strPtr("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("banana", strPtr("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("apricot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("avocado", strPtr("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("cherry"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		it   *Iterator
+		want []string
+	}{
+		{"all", l.Range("", "", false), []string{"apple=1", "avocado=3", "banana=2", "blueberry=1"}},
+		{"all reverse", l.Range("", "", true), []string{"blueberry=1", "banana=2", "avocado=3", "apple=1"}},
+		{"range", l.Range("apricot", "blueberry", false), []string{"avocado=3", "banana=2"}},
+		{"range reverse", l.Range("apricot", "blueberry", true), []string{"banana=2", "avocado=3"}},
+		{"prefix", l.Prefix("a", false), []string{"apple=1", "avocado=3"}},
+		{"prefix reverse", l.Prefix("b", true), []string{"blueberry=1", "banana=2"}},
+	} {
+		got := collect(tc.it)
+		if err := tc.it.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	it := l.Range("", "", false)
+	it.Seek("b")
+	if got := collect(it); !reflect.DeepEqual(got, []string{"banana=2", "blueberry=1"}) {
+		t.Fatalf("Seek(b) = %v", got)
+	}
+	it.Seek("az")
+	if !it.Valid() || it.Key() != "banana" {
+		t.Fatalf("Seek(az) at %q, valid=%v", it.Key(), it.Valid())
+	}
+	it.Close()
+
+	rev := l.Range("", "", true)
+	rev.Seek("bz")
+	if got := collect(rev); !reflect.DeepEqual(got, []string{"blueberry=1", "banana=2", "avocado=3", "apple=1"}) {
+		t.Fatalf("reverse Seek(bz) = %v", got)
+	}
+	rev.Close()
+}
+
+func TestIteratorPinsTablesAcrossCompaction(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	l, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("a", strPtr("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	it := l.Range("", "", false)
+	if err := l.Put("b", strPtr("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(it); !reflect.DeepEqual(got, []string{"a=1"}) {
+		t.Fatalf("pinned iterator = %v, want [a=1]", got)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 2
+	opts.BaseLevelBytes = 4 << 10
+	opts.LevelSizeMultiplier = 2
+	opts.TargetFileSize = 1 << 10
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]string)
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key%04d", (i*37+round*11)%400)
+			val := fmt.Sprintf("value-%d-%d", round, i)
+			if err := l.Put(key, &val); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+	}
+
+	if len(l.files) < 3 {
+		t.Fatalf("expected data to reach L2, got %d levels", len(l.files))
+	}
+	checkLevels := func(l *LSM) {
+		t.Helper()
+		for level := 1; level < len(l.files); level++ {
+			tables := l.files[level]
+			for i := 1; i < len(tables); i++ {
+				if tables[i-1].maxKey >= tables[i].minKey {
+					t.Fatalf("L%d tables overlap: [%s,%s] and [%s,%s]", level,
+						tables[i-1].minKey, tables[i-1].maxKey, tables[i].minKey, tables[i].maxKey)
+				}
+			}
+			if level < len(l.files)-1 && tablesBytes(tables) > l.levelTargetBytes(level) {
+				t.Fatalf("L%d holds %d bytes, target %d", level, tablesBytes(tables), l.levelTargetBytes(level))
+			}
+		}
+		for key, val := range want {
+			if got := l.Get(key); got == nil || *got != val {
+				t.Fatalf("Get(%q) = %v, want %q", key, got, val)
+			}
+		}
+	}
+	checkLevels(l)
+
+	reopened, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLevels(reopened)
+}
+
+func writeV1Table(t *testing.T, path string, table *MemTable) {
+	t.Helper()
+	entries := table.SortedEntries()
+	bloom := NewBloomFilter(len(entries))
+	bloom.hashes = 0
+	for _, e := range entries {
+		bloom.AddString(e.Key)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(headerBytes(uint32(len(entries)), bloom))
+	keys := make([]string, 0, len(entries))
+	offsets := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+		offsets = append(offsets, uint64(buf.Len()))
+		if _, err := writeRecord(&buf, e.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexStart := uint64(buf.Len())
+	var u32 [4]byte
+	var u64 [8]byte
+	var keyOffsets []uint32
+	for _, k := range keys {
+		keyOffsets = append(keyOffsets, uint32(uint64(buf.Len())-indexStart))
+		binary.LittleEndian.PutUint32(u32[:], uint32(len(k)))
+		buf.Write(u32[:])
+		buf.WriteString(k)
+	}
+	for _, off := range offsets {
+		binary.LittleEndian.PutUint64(u64[:], off)
+		buf.Write(u64[:])
+	}
+	for _, ko := range keyOffsets {
+		binary.LittleEndian.PutUint32(u32[:], ko)
+		buf.Write(u32[:])
+	}
+	indexLen := uint64(buf.Len()) - indexStart
+
+	binary.LittleEndian.PutUint64(u64[:], indexStart)
+	buf.Write(u64[:])
+	binary.LittleEndian.PutUint32(u32[:], uint32(indexLen))
+	buf.Write(u32[:])
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestV1TablesStayReadable(t *testing.T) {
+	dir := t.TempDir()
+	old := NewMemTable()
+	for i := 0; i < 100; i++ {
+		old.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("v1-%d", i)), uint32(i))
+	}
+	old.Put("key050", nil, 100)
+	path := filepath.Join(dir, "old.sst")
+	writeV1Table(t, path, old)
+
+	v1, err := OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.version != sstFormatV1 || v1.minKey != "key000" || v1.maxKey != "key099" {
+		t.Fatalf("v1 table loaded as version %d [%s,%s]", v1.version, v1.minKey, v1.maxKey)
+	}
+	v, ok, err := v1.Get("key042")
+	if err != nil || !ok || *v.value != "v1-42" {
+		t.Fatalf("v1 Get = %+v, %v, %v", v, ok, err)
+	}
+
+	newer := NewMemTable()
+	newer.Put("key042", strPtr("v2"), 200)
+	v2, err := CreateSSTableFromMemTable(filepath.Join(dir, "new.sst"), newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := mergeSSTables(filepath.Join(dir, "merged.sst"), tableOptions{blockSize: 64}, mergePolicy{op: LastWriteWins{}, bottom: true}, v1, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.version != sstFormatValueLog || len(merged.blocks) < 2 || merged.keyCount != 99 {
+		t.Fatalf("merged table: version %d, %d blocks, %d keys", merged.version, len(merged.blocks), merged.keyCount)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		want := fmt.Sprintf("v1-%d", i)
+		if i == 42 {
+			want = "v2"
+		}
+		v, ok, err := merged.Get(key)
+		if i == 50 {
+			if err != nil || ok {
+				t.Fatalf("Get(%q) after bottom merge: ok=%v err=%v", key, ok, err)
+			}
+			continue
+		}
+		if err != nil || !ok || *v.value != want {
+			t.Fatalf("Get(%q) = %+v, %v, %v; want %q", key, v, ok, err, want)
+		}
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	dir := t.TempDir()
+	mem := NewMemTable()
+	for i := 0; i < 200; i++ {
+		mem.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("value-%d", i)), uint32(i))
+	}
+	cache := NewBlockCache(1 << 20)
+	sst, err := createSSTable(filepath.Join(dir, "t.sst"), mem, tableOptions{blockSize: 256, cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sst.blocks) < 4 {
+		t.Fatalf("expected several blocks, got %d", len(sst.blocks))
+	}
+
+	if _, ok, err := sst.Get("key123"); err != nil || !ok {
+		t.Fatalf("Get: ok=%v err=%v", ok, err)
+	}
+	cached := cache.Size()
+	if cached == 0 {
+		t.Fatal("block was not cached")
+	}
+	if _, ok, err := sst.Get("key124"); err != nil || !ok {
+		t.Fatalf("Get: ok=%v err=%v", ok, err)
+	}
+	if cache.Size() != cached {
+		t.Fatalf("second Get in the same block read from disk: cache %d -> %d", cached, cache.Size())
+	}
+
+	small := NewBlockCache(512)
+	sst.cache = small
+	for i := 0; i < 200; i++ {
+		if _, ok, err := sst.Get(fmt.Sprintf("key%03d", i)); err != nil || !ok {
+			t.Fatalf("Get: ok=%v err=%v", ok, err)
+		}
+	}
+	if small.Size() > 512 {
+		t.Fatalf("cache holds %d bytes, capacity 512", small.Size())
+	}
+
+	it := sst.newIterator(true)
+	it.first()
+	n := 0
+	for ; it.valid(); it.next() {
+		if want := fmt.Sprintf("key%03d", 199-n); it.key() != want {
+			t.Fatalf("reverse key %d = %q, want %q", n, it.key(), want)
+		}
+		n++
+	}
+	if n != 200 || it.err() != nil {
+		t.Fatalf("reverse scan saw %d keys, err %v", n, it.err())
+	}
+}
+
+func TestMixedCompressionMerge(t *testing.T) {
+	dir := t.TempDir()
+	codecs := []Compression{CompressionNone, CompressionFlate, CompressionSnappy}
+	var tables []*SSTable
+	for i, c := range codecs {
+		mem := NewMemTable()
+		for k := 0; k < 300; k++ {
+			val := strings.Repeat(fmt.Sprintf("posting-%d-%d ", i, k%7), 20)
+			mem.Put(fmt.Sprintf("term%04d", k*len(codecs)+i), &val, uint32(k))
+		}
+		sst, err := createSSTable(filepath.Join(dir, c.String()+".sst"), mem, tableOptions{blockSize: 1 << 10, compression: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, sst)
+	}
+	if tables[1].size*2 > tables[0].size || tables[2].size*2 > tables[0].size {
+		t.Fatalf("compressed tables not smaller: none=%d flate=%d snappy=%d", tables[0].size, tables[1].size, tables[2].size)
+	}
+
+	merged, err := mergeSSTables(filepath.Join(dir, "merged.sst"), tableOptions{blockSize: 1 << 10, compression: CompressionFlate}, mergePolicy{op: LastWriteWins{}}, tables...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.keyCount != 900 {
+		t.Fatalf("merged %d keys, want 900", merged.keyCount)
+	}
+	for k := 0; k < 900; k++ {
+		want := strings.Repeat(fmt.Sprintf("posting-%d-%d ", k%3, (k/3)%7), 20)
+		v, ok, err := merged.Get(fmt.Sprintf("term%04d", k))
+		if err != nil || !ok || *v.value != want {
+			t.Fatalf("Get(term%04d) = %v, %v; want %q", k, ok, err, want)
+		}
+	}
+}
+
+func flipByte(t *testing.T, path string, off int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off < 0 {
+		off += int64(len(data))
+	}
+	data[off] ^= 0x40
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSTableCorruption(t *testing.T) {
+	dir := t.TempDir()
+	mem := NewMemTable()
+	for i := 0; i < 200; i++ {
+		mem.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("value-%d", i)), uint32(i))
+	}
+	write := func(name string) (string, *SSTable) {
+		path := filepath.Join(dir, name)
+		sst, err := createSSTable(path, mem, tableOptions{blockSize: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path, sst
+	}
+
+	path, sst := write("block.sst")
+	h := sst.blocks[3]
+	_ = sst.Close()
+	flipByte(t, path, int64(h.offset)+int64(h.length)/2)
+	sst, err := OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = sst.Get(h.firstKey)
+	var ce *CorruptionError
+	if !errors.Is(err, ErrCorruption) || !errors.As(err, &ce) || ce.Path != path || ce.Offset != h.offset {
+		t.Fatalf("Get in damaged block = %v, want corruption at %s:%d", err, path, h.offset)
+	}
+	if v, ok, err := sst.Get("key000"); err != nil || !ok || *v.value != "value-0" {
+		t.Fatalf("Get in intact block = %v, %v", ok, err)
+	}
+	it := sst.newIterator(false)
+	for it.first(); it.valid(); it.next() {
+	}
+	if !errors.Is(it.err(), ErrCorruption) {
+		t.Fatalf("scan over damaged block: err %v", it.err())
+	}
+
+	for name, off := range map[string]int64{"footer.sst": -20, "magic.sst": -1, "index.sst": -45} {
+		path, sst := write(name)
+		_ = sst.Close()
+		flipByte(t, path, off)
+		if _, err := OpenSSTable(path); !errors.Is(err, ErrCorruption) {
+			t.Fatalf("%s: OpenSSTable = %v, want ErrCorruption", name, err)
+		}
+	}
+
+	path, sst = write("header.sst")
+	_ = sst.Close()
+	flipByte(t, path, int64(sst.blocks[len(sst.blocks)-1].offset)+int64(sst.blocks[len(sst.blocks)-1].length)+2)
+	if _, err := OpenSSTable(path); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("damaged header: OpenSSTable = %v, want ErrCorruption", err)
+	}
+
+	path, sst = write("truncated.sst")
+	_ = sst.Close()
+	if err := os.Truncate(path, int64(sst.size)-7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSSTable(path); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("truncated table: OpenSSTable = %v, want ErrCorruption", err)
+	}
+}
+
+func TestGetSurfacesCorruption(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 10
+	opts.BlockCacheBytes = 0
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"old", "new"} {
+		if err := l.Put("k", strPtr(v)); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newest := l.files[0][len(l.files[0])-1]
+	h := newest.blocks[0]
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, newest.Path(), int64(h.offset)+1)
+
+	if l, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got, err := l.GetErr("k")
+	if !errors.Is(err, ErrCorruption) || got != nil {
+		t.Fatalf("GetErr over a damaged newer table = %v, %v; want ErrCorruption", got, err)
+	}
+	if got := l.Get("k"); got != nil {
+		t.Fatalf("Get fell through to shadowed value %q", *got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.BlockSize = 256
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			val := fmt.Sprintf("value-%d-%d", round, i)
+			if err := l.Put(fmt.Sprintf("r%d-key%03d", round, i), &val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if damaged, err := l.Verify(); err != nil || len(damaged) != 0 {
+		t.Fatalf("Verify on intact tree = %v, %v", damaged, err)
+	}
+
+	victim := l.files[0][1]
+	h := victim.blocks[2]
+	flipByte(t, victim.Path(), int64(h.offset)+1)
+	damaged, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damaged) != 1 {
+		t.Fatalf("Verify reported %d ranges, want 1: %v", len(damaged), damaged)
+	}
+	d := damaged[0]
+	if d.Path != victim.Path() || d.Level != 0 || d.StartKey != h.firstKey || d.EndKey != victim.blocks[3].firstKey || !errors.Is(d.Err, ErrCorruption) {
+		t.Fatalf("damaged range = %+v, want %s [%s,%s)", d, victim.Path(), h.firstKey, victim.blocks[3].firstKey)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range [][2]string{{"a", "a1"}, {"b", "b1"}, {"c", "c1"}} {
+		if err := l.Put(kv[0], strPtr(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := l.Snapshot()
+	if err := l.Put("a", strPtr("a2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("d", strPtr("d2")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		if got := snap.Get("a"); got == nil || *got != "a1" {
+			t.Fatalf("%s: snapshot Get(a) = %v, want a1", stage, got)
+		}
+		if got := snap.Get("b"); got == nil || *got != "b1" {
+			t.Fatalf("%s: snapshot Get(b) = %v, want b1", stage, got)
+		}
+		if got := snap.Get("d"); got != nil {
+			t.Fatalf("%s: snapshot Get(d) = %q, want nil", stage, *got)
+		}
+		if got := l.Get("a"); got == nil || *got != "a2" {
+			t.Fatalf("%s: Get(a) = %v, want a2", stage, got)
+		}
+		if got := l.Get("b"); got != nil {
+			t.Fatalf("%s: Get(b) = %q, want nil", stage, *got)
+		}
+		if got, want := collect(snap.Range("", "", false)), []string{"a=a1", "b=b1", "c=c1"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: snapshot scan = %v, want %v", stage, got, want)
+		}
+		if got, want := collect(snap.Range("", "", true)), []string{"c=c1", "b=b1", "a=a1"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: snapshot reverse scan = %v, want %v", stage, got, want)
+		}
+		if got, want := collect(l.Range("a", "e", false)), []string{"a=a2", "c=c1", "d=d2"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: scan = %v, want %v", stage, got, want)
+		}
+	}
+	check("memtable")
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("e", strPtr("e2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.files) < 2 || len(l.files[1]) == 0 {
+		t.Fatalf("expected data in L1, layout %v", layoutOf(l))
+	}
+	check("compacted")
+
+	snap.Release()
+	for _, key := range []string{"a", "c"} {
+		if err := l.Put(key, strPtr(key+"3")); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := 0
+	for _, level := range l.files {
+		for _, table := range level {
+			entries += table.keyCount
+		}
+	}
+	if entries != 4 {
+		t.Fatalf("%d entries remain after releasing the snapshot, want 4: %v", entries, layoutOf(l))
+	}
+}
+
+func TestSnapshotMergeOperands(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	opts.MergeOperator = RoaringUnion{}
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merge := func(ids ...uint32) {
+		t.Helper()
+		if err := l.Merge("term", *bitmapValue(ids...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bitmap := func(r Reader) []uint32 {
+		t.Helper()
+		raw := r.Get("term")
+		if raw == nil {
+			return nil
+		}
+		bm := roaring.New()
+		if _, err := bm.FromBuffer([]byte(*raw)); err != nil {
+			t.Fatal(err)
+		}
+		return bm.ToArray()
+	}
+
+	merge(1)
+	first := l.Snapshot()
+	merge(2)
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	second := l.Snapshot()
+	merge(3)
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		r    Reader
+		want []uint32
+	}{{first, []uint32{1}}, {second, []uint32{1, 2}}, {l, []uint32{1, 2, 3}}} {
+		if got := bitmap(tc.r); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("bitmap = %v, want %v", got, tc.want)
+		}
+	}
+	first.Release()
+	second.Release()
+}
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Sync = SyncEveryWrite
+	opts.MergeOperator = RoaringUnion{}
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("gone", strPtr("x")); err != nil {
+		t.Fatal(err)
+	}
+	before := l.Snapshot()
+	seq := l.sequenceNumber
+
+	b := NewWriteBatch()
+	b.Put("doc", bitmapValue(1))
+	b.Merge("doc", *bitmapValue(2))
+	b.Merge("other", *bitmapValue(7))
+	b.Delete("gone")
+	if err := l.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.sequenceNumber - seq; got != 4 {
+		t.Fatalf("batch consumed %d sequence numbers, want 4", got)
+	}
+	if got := before.Get("doc"); got != nil {
+		t.Fatal("snapshot taken before the batch sees its writes")
+	}
+	before.Release()
+
+	torn := NewWriteBatch()
+	torn.Merge("doc", *bitmapValue(3))
+	torn.Put("late", strPtr("v"))
+	if err := l.Write(torn); err != nil {
+		t.Fatal(err)
+	}
+	path := walPath(dir, l.wal.id)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, st.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string][]uint32{"doc": {1, 2}, "other": {7}} {
+		raw := reopened.Get(key)
+		if raw == nil {
+			t.Fatalf("Get(%q) = nil after replay", key)
+		}
+		bm := roaring.New()
+		if _, err := bm.FromBuffer([]byte(*raw)); err != nil {
+			t.Fatal(err)
+		}
+		if got := bm.ToArray(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Get(%q) = %v, want %v", key, got, want)
+		}
+	}
+	if got := reopened.Get("gone"); got != nil {
+		t.Fatalf("Get(gone) = %q, want deleted", *got)
+	}
+	if got := reopened.Get("late"); got != nil {
+		t.Fatalf("Get(late) = %q, want torn batch dropped entirely", *got)
+	}
+}
+
+func TestCloseFlushesAndReleasesTables(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, 8)
+	for i := 0; i < 100; i++ {
+		if err := l.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.mutex.RLock()
+	var tables []*SSTable
+	for _, level := range l.files {
+		tables = append(tables, level...)
+	}
+	l.mutex.RUnlock()
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := l.Put("late", strPtr("v")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Put after Close = %v, want ErrClosed", err)
+	}
+	for _, table := range tables {
+		if table.refs.Load() != 0 || table.f != nil {
+			t.Fatalf("%s still open after Close", table.Path())
+		}
+	}
+	segments, err := listWALSegments(OSFS{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range segments {
+		if st, err := os.Stat(walPath(dir, id)); err != nil || st.Size() != 0 {
+			t.Fatalf("WAL segment %d left with data after Close", id)
+		}
+	}
+
+	reopened := openTestLSM(t, dir, 8)
+	defer reopened.Close()
+	for i := 0; i < 100; i++ {
+		if got := reopened.Get(fmt.Sprintf("key%03d", i)); got == nil || *got != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get(key%03d) = %v after reopen", i, got)
+		}
+	}
+}
+
+func TestWriteStallBoundsQueues(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxSize = 4
+	opts.MaxFilesPerLevel = 2
+	opts.MaxImmutableMemTables = 2
+	opts.L0SlowdownWritesTrigger = 3
+	opts.L0StopWritesTrigger = 4
+	opts.CompactionWorkers = 3
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := l.Put(fmt.Sprintf("w%d-key%03d", w, i), strPtr("v")); err != nil {
+					errs <- err
+					return
+				}
+				l.mutex.RLock()
+				immutables, l0 := len(l.immutables), len(l.levelFilesLocked(0))
+				l.mutex.RUnlock()
+				if immutables > opts.MaxImmutableMemTables || l0 > opts.L0StopWritesTrigger+opts.MaxImmutableMemTables {
+					errs <- fmt.Errorf("queues grew past limits: %d immutable memtables, %d L0 files", immutables, l0)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 200; i++ {
+			if got := l.Get(fmt.Sprintf("w%d-key%03d", w, i)); got == nil {
+				t.Fatalf("w%d-key%03d missing", w, i)
+			}
+		}
+	}
+}
+
+func TestZeroOptionsAreDefaulted(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{MaxSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 300; i++ {
+		if err := l.Put(fmt.Sprintf("key%04d", i), strPtr(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if got := l.Get(key); got == nil || *got != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get(%s) = %v", key, got)
+		}
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	var tables int
+	for _, level := range l.files {
+		tables += len(level)
+	}
+	if tables > 4 {
+		t.Fatalf("%d tables with a zero TargetFileSize, want it defaulted", tables)
+	}
+}
+
+func TestBackgroundError(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	reported := make(chan error, 1)
+	opts.OnBackgroundError = func(err error) { reported <- err }
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("a", strPtr("v")); err != nil {
+		t.Fatal(err)
+	}
+	l.mutex.Lock()
+	blocked := filepath.Join(dir, fmt.Sprintf("L0-%d.sst", l.nextFileID))
+	l.mutex.Unlock()
+	if err := os.Mkdir(blocked, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Compact()
+	if err == nil {
+		t.Fatal("Compact succeeded although the flush target is a directory")
+	}
+	if l.Err() != err {
+		t.Fatalf("Err() = %v, want %v", l.Err(), err)
+	}
+	if got := <-reported; got != err {
+		t.Fatalf("callback got %v, want %v", got, err)
+	}
+	if werr := l.Put("b", strPtr("v")); werr != err {
+		t.Fatalf("Put after background error = %v, want %v", werr, err)
+	}
+	if got := l.Get("a"); got == nil || *got != "v" {
+		t.Fatalf("Get(a) = %v, want unflushed value still readable", got)
+	}
+	if cerr := l.Close(); !errors.Is(cerr, err) {
+		t.Fatalf("Close = %v, want %v", cerr, err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	falsePositives := func(b *BloomFilter) float64 {
+		hits := 0
+		for i := 0; i < 10*n; i++ {
+			if b.MightContainString(fmt.Sprintf("absent-%d", i)) {
+				hits++
+			}
+		}
+		return float64(hits) / (10 * n)
+	}
+	for _, rate := range []float64{0.05, 0.01, 0.001} {
+		b := NewBloomFilterWithBitsPerKey(n, BloomBitsPerKeyForFalsePositiveRate(rate))
+		for i := 0; i < n; i++ {
+			b.AddString(fmt.Sprintf("key-%d", i))
+		}
+		for i := 0; i < n; i++ {
+			if !b.MightContainString(fmt.Sprintf("key-%d", i)) {
+				t.Fatalf("rate %v: false negative for key-%d", rate, i)
+			}
+		}
+		if got := falsePositives(b); got > 2*rate {
+			t.Fatalf("rate %v: measured false-positive rate %v with %d hashes", rate, got, b.hashes)
+		}
+
+		_, decoded, _, err := decodeHeader(headerBytes(n, b), false)
+		if err != nil || !reflect.DeepEqual(decoded, b) {
+			t.Fatalf("rate %v: header round trip = %+v, %v", rate, decoded, err)
+		}
+	}
+	if k := NewBloomFilter(n).hashes; k != 7 {
+		t.Fatalf("default filter uses %d hashes, want 7", k)
+	}
+
+	legacy := NewBloomFilter(n)
+	legacy.hashes = 0
+	for i := 0; i < n; i++ {
+		legacy.AddString(fmt.Sprintf("key-%d", i))
+	}
+	_, decoded, _, err := decodeHeader(headerBytes(n, legacy), false)
+	if err != nil || decoded.hashes != 0 {
+		t.Fatalf("legacy header = %+v, %v", decoded, err)
+	}
+	for i := 0; i < n; i++ {
+		if !decoded.MightContainString(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("legacy filter lost key-%d", i)
+		}
+	}
+}
+
+func TestBloomPerLevel(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	opts.Bloom = BloomPolicy{BitsPerKey: 4}
+	opts.BloomPerLevel = []BloomPolicy{{}, {FalsePositiveRate: 0.001}}
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 200; i++ {
+			if err := l.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("v%d", round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Put("key000", strPtr("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.files) < 2 || len(l.files[0]) == 0 || len(l.files[1]) == 0 {
+		t.Fatalf("expected tables in L0 and L1, layout %v", layoutOf(l))
+	}
+	want := []uint32{bloomHashCount(4), bloomHashCount(BloomBitsPerKeyForFalsePositiveRate(0.001))}
+	for level, k := range want {
+		for _, table := range l.files[level] {
+			if table.bloom.hashes != k {
+				t.Fatalf("L%d table uses %d hashes, want %d", level, table.bloom.hashes, k)
+			}
+		}
+	}
+
+	before := l.BloomStats()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%03d-%d", i%200, i)
+		if got := l.Get(key); got != nil {
+			t.Fatalf("Get(%s) = %q", key, *got)
+		}
+	}
+	if got := l.Get("key100"); got == nil || *got != "v1" {
+		t.Fatalf("Get(key100) = %v, want v1", got)
+	}
+	stats := l.BloomStats()
+	checks := stats.Checks - before.Checks
+	negatives := stats.Negatives - before.Negatives
+	falsePositives := stats.FalsePositives - before.FalsePositives
+	if checks == 0 || negatives == 0 || negatives+falsePositives != checks-1 {
+		t.Fatalf("bloom stats after lookups = %+v, before %+v", stats, before)
+	}
+}
+
+func TestMemTableSkiplist(t *testing.T) {
+	mem := NewMemTable()
+	var want []string
+	for i := 999; i >= 0; i-- {
+		key := fmt.Sprintf("key%03d", i)
+		mem.Put(key, strPtr("v"), uint32(1000-i))
+		want = append([]string{key}, want...)
+	}
+	mem.Put("key500", strPtr("longer value"), 2000)
+	if got, want := mem.Size(), int64(1000*len("key000")+1000*len("v")+len("longer value")-len("v")); got != want {
+		t.Fatalf("Size() = %d bytes, want %d", got, want)
+	}
+	if mem.Len() != 1000 {
+		t.Fatalf("Len() = %d, want 1000", mem.Len())
+	}
+	var keys []string
+	for _, e := range mem.SortedEntries() {
+		keys = append(keys, e.Key)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("SortedEntries out of order")
+	}
+	if v, ok := mem.Get("key500"); !ok || *v.value != "longer value" {
+		t.Fatalf("Get(key500) = %v, %v", v, ok)
+	}
+
+	it := mem.newIterator(true)
+	it.seek("key500x")
+	if !it.valid() || it.key() != "key500" {
+		t.Fatalf("reverse seek landed on %v", it.node)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				prev := ""
+				it := mem.newIterator(false)
+				for it.first(); it.valid(); it.next() {
+					if it.key() < prev {
+						t.Errorf("concurrent scan went backwards: %s after %s", it.key(), prev)
+						return
+					}
+					prev = it.key()
+				}
+				if _, ok := mem.Get("key000"); !ok {
+					t.Errorf("concurrent Get lost key000")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2000; i++ {
+		mem.Put(fmt.Sprintf("new%04d", i), strPtr("v"), uint32(3000+i))
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestMemTableFlushesByBytes(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, 1<<10)
+	defer l.Close()
+	for i := 0; i < 50; i++ {
+		if err := l.Put(fmt.Sprintf("small%02d", i), strPtr("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.mutex.RLock()
+	rotated := len(l.immutables) > 0 || len(l.files) > 0
+	l.mutex.RUnlock()
+	if rotated {
+		t.Fatalf("50 small entries rotated a 1KiB memtable")
+	}
+	big := strings.Repeat("x", 2<<10)
+	if err := l.Put("big", &big); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("after", strPtr("v")); err != nil {
+		t.Fatal(err)
+	}
+	l.mutex.RLock()
+	size, immutables := l.memTable.Size(), len(l.immutables)
+	l.mutex.RUnlock()
+	if size != int64(len("after")+1) {
+		t.Fatalf("memtable holds %d bytes after rotation, immutables %d", size, immutables)
+	}
+	if got := l.Get("big"); got == nil || *got != big {
+		t.Fatalf("Get(big) lost the value after rotation")
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			if err := l.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("v%d", round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Put("pending", strPtr("v")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		l.Get(fmt.Sprintf("key%03d", i))
+		l.Get(fmt.Sprintf("key%03d-absent", i))
+	}
+
+	s := l.Stats()
+	if s.MemTableEntries != 1 || s.MemTableBytes != int64(len("pending")+1) {
+		t.Fatalf("memtable stats = %d entries, %d bytes", s.MemTableEntries, s.MemTableBytes)
+	}
+	if s.Flushes.Count != 3 || s.Flushes.BytesWritten == 0 || s.Flushes.Duration <= 0 {
+		t.Fatalf("flush stats = %+v", s.Flushes)
+	}
+	if s.Compactions.Count == 0 || s.Compactions.BytesWritten == 0 {
+		t.Fatalf("compaction stats = %+v", s.Compactions)
+	}
+	files, size := 0, uint64(0)
+	for _, ls := range s.Levels {
+		files += ls.Files
+		size += ls.Bytes
+	}
+	if files == 0 || size == 0 || len(s.Levels) != len(l.files) {
+		t.Fatalf("level stats = %+v", s.Levels)
+	}
+	if s.Gets.Count != 100 || s.Gets.Latency.Count() != 100 {
+		t.Fatalf("get stats = %+v", s.Gets)
+	}
+	if amp := s.Gets.ReadAmplification(); amp < 1 {
+		t.Fatalf("read amplification %v, want at least one table per Get", amp)
+	}
+	if s.Bloom.Checks == 0 || s.Bloom.Negatives == 0 {
+		t.Fatalf("bloom stats = %+v", s.Bloom)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE lsm_level_files gauge\n",
+		`lsm_level_files{level="0"} `,
+		"lsm_flushes_total 3\n",
+		`lsm_get_latency_seconds_bucket{le="+Inf"} 100` + "\n",
+		"lsm_get_latency_seconds_count 100\n",
+		fmt.Sprintf("lsm_bloom_negatives_total %d\n", s.Bloom.Negatives),
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("exporter output lacks %q:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	racing := Stats{Gets: GetStats{Count: 7, Latency: Histogram{Bounds: []time.Duration{time.Millisecond}, Counts: []uint64{2, 3}}}}
+	if err := racing.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "lsm_get_latency_seconds_count 5\n") {
+		t.Fatalf("histogram count does not match its buckets:\n%s", out)
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	dir := t.TempDir()
+	old := NewMemTable()
+	for i := 0; i < 100; i++ {
+		old.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("v1-%d", i)), uint32(i))
+	}
+	writeV1Table(t, filepath.Join(dir, "old.sst"), old)
+	v1, err := openSSTable(filepath.Join(dir, "old.sst"), tableOptions{mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := v1.Get("key042"); err != nil || !ok || *v.value != "v1-42" {
+		t.Fatalf("mapped v1 Get = %+v, %v, %v", v, ok, err)
+	}
+	if err := v1.Close(); err != nil || v1.data != nil {
+		t.Fatalf("Close = %v, mapping left at %p", err, v1.data)
+	}
+
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	opts.MmapReads = true
+	opts.Compression = CompressionNone
+	l, err := Open(filepath.Join(dir, "lsm"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 200; i++ {
+		if err := l.Put(fmt.Sprintf("key%03d", i), strPtr(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	pinned := l.files[0][0]
+	if runtime.GOOS == "linux" && pinned.data == nil {
+		t.Fatal("table opened without a mapping")
+	}
+	if err := pinned.readBlock(0, func(data []byte) error {
+		if pinned.data != nil && &data[0] != &pinned.data[pinned.blocks[0].offset] {
+			t.Fatal("uncompressed block copied out of the mapping")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	it := l.Range("", "", false)
+	for i := 0; i < 200; i += 2 {
+		if err := l.Put(fmt.Sprintf("key%03d", i), strPtr("rewritten")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if !pinned.obsolete.Load() {
+		t.Fatalf("compaction kept %s, layout %v", pinned.Path(), layoutOf(l))
+	}
+	if got := collect(it); len(got) != 200 || got[0] != "key000=v0" {
+		t.Fatalf("iterator over compacted-away mapping = %d entries, first %v", len(got), got[:1])
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pinned.data != nil {
+		t.Fatal("mapping survived the last reference")
+	}
+	for i := 0; i < 200; i++ {
+		want := fmt.Sprintf("v%d", i)
+		if i%2 == 0 {
+			want = "rewritten"
+		}
+		if got := l.Get(fmt.Sprintf("key%03d", i)); got == nil || *got != want {
+			t.Fatalf("Get(key%03d) = %v, want %s", i, got, want)
+		}
+	}
+}
+
+func TestTableCacheBoundsOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 100
+	opts.L0StopWritesTrigger = 200
+	opts.MaxOpenTables = 2
+	opts.BlockCacheBytes = 0
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for table := 0; table < 8; table++ {
+		for i := 0; i < 20; i++ {
+			if err := l.Put(fmt.Sprintf("t%d-key%02d", table, i), strPtr(fmt.Sprintf("v%d", table))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(l.files[0]) != 8 {
+		t.Fatalf("expected 8 L0 tables, layout %v", layoutOf(l))
+	}
+	openFiles := func() int {
+		n := 0
+		for _, table := range l.files[0] {
+			table.fileMutex.Lock()
+			if table.f != nil {
+				n++
+			}
+			table.fileMutex.Unlock()
+		}
+		return n
+	}
+	if n := openFiles(); n > 2 {
+		t.Fatalf("%d tables hold open files, cap 2", n)
+	}
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				for table := 0; table < 8; table++ {
+					key := fmt.Sprintf("t%d-key%02d", (table+r)%8, round)
+					if got := l.Get(key); got == nil || *got != fmt.Sprintf("v%d", (table+r)%8) {
+						t.Errorf("Get(%s) = %v", key, got)
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	it := l.Range("", "", false)
+	if got := collect(it); len(got) != 160 {
+		t.Fatalf("scan over evicted tables returned %d entries", len(got))
+	}
+	wg.Wait()
+	if n := openFiles(); n > 2 {
+		t.Fatalf("%d tables hold open files after reads, cap 2", n)
+	}
+	if s := l.Stats(); s.OpenTables > 2 {
+		t.Fatalf("Stats reports %d open tables", s.OpenTables)
+	}
+}
+
+func TestSubcompactionsMatchSerialMerge(t *testing.T) {
+	dir := t.TempDir()
+	opts := tableOptions{blockSize: 256}
+	var inputs []*SSTable
+	seq := uint32(0)
+	for table := 0; table < 4; table++ {
+		mem := NewMemTable()
+		for i := table; i < 2000; i += 1 + table {
+			seq++
+			key := fmt.Sprintf("key%04d", i)
+			switch i % 7 {
+			case 0:
+				mem.Put(key, nil, seq)
+			case 1:
+				if err := mem.Merge(key, fmt.Sprintf("op%d", table), seq, LastWriteWins{}); err != nil {
+					t.Fatal(err)
+				}
+			default:
+				mem.Put(key, strPtr(fmt.Sprintf("t%d-%d", table, i)), seq)
+			}
+		}
+		sst, err := createSSTable(filepath.Join(dir, fmt.Sprintf("in%d.sst", table)), mem, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, sst)
+	}
+	snapshots := []uint32{seq / 3, seq / 2}
+
+	contents := func(tables []*SSTable) []string {
+		var out []string
+		for i, table := range tables {
+			if i > 0 && table.minKey <= tables[i-1].maxKey {
+				t.Fatalf("outputs overlap: %s..%s then %s..%s", tables[i-1].minKey, tables[i-1].maxKey, table.minKey, table.maxKey)
+			}
+			it := table.newIterator(false)
+			for it.first(); it.valid(); it.next() {
+				v, err := it.value()
+				if err != nil {
+					t.Fatal(err)
+				}
+				val := "<nil>"
+				if v.value != nil {
+					val = *v.value
+				}
+				out = append(out, fmt.Sprintf("%s@%d:%d=%s", it.key(), v.sequenceNumber, v.kind, val))
+			}
+			if err := it.err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out
+	}
+
+	for _, bottom := range []bool{false, true} {
+		id := 0
+		newPath := func() string {
+			id++
+			return filepath.Join(dir, fmt.Sprintf("out-%v-%d.sst", bottom, id))
+		}
+		serial, err := compactSSTables(newPath, opts, mergePolicy{op: LastWriteWins{}, bottom: bottom, snapshots: snapshots}, 4<<10, 1, inputs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ranges := subcompactionRanges(inputs, 4); len(ranges) != 4 {
+			t.Fatalf("split into %d ranges, want 4", len(ranges))
+		}
+		var mu sync.Mutex
+		parallel, err := compactSSTables(func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return newPath()
+		}, opts, mergePolicy{op: LastWriteWins{}, bottom: bottom, snapshots: snapshots}, 4<<10, 4, inputs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, got := contents(serial), contents(parallel)
+		if len(want) == 0 || !reflect.DeepEqual(got, want) {
+			t.Fatalf("bottom=%v: parallel merge produced %d entries, serial %d", bottom, len(got), len(want))
+		}
+	}
+}
+
+func TestCheckpointAndIncrementalBackup(t *testing.T) {
+	root := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 2
+	l, err := Open(filepath.Join(root, "live"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	put := func(round, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := l.Put(fmt.Sprintf("r%d-key%03d", round, i), strPtr(fmt.Sprintf("v%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(dir string, rounds int) {
+		t.Helper()
+		c, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for round := 0; round < rounds; round++ {
+			for i := 0; i < 100; i++ {
+				if got := c.Get(fmt.Sprintf("r%d-key%03d", round, i)); got == nil || *got != fmt.Sprintf("v%d", i) {
+					t.Fatalf("%s: Get(r%d-key%03d) = %v", dir, round, i, got)
+				}
+			}
+		}
+		if got := c.Get(fmt.Sprintf("r%d-key000", rounds)); got != nil {
+			t.Fatalf("%s holds data written after it was taken", dir)
+		}
+	}
+
+	for round := 0; round < 3; round++ {
+		put(round, 100)
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(3, 100)
+	checkpoint := filepath.Join(root, "checkpoint")
+	if err := l.Checkpoint(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Checkpoint(checkpoint); !errors.Is(err, errCheckpointDirNotEmpty) {
+		t.Fatalf("second checkpoint into the same directory = %v", err)
+	}
+	full, err := l.Backup(filepath.Join(root, "backup-1"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Tables == 0 || full.Copied != full.Tables {
+		t.Fatalf("full backup = %+v", full)
+	}
+
+	put(4, 100)
+	if err := l.Put("r5-key000", strPtr("late")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("r5-key000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	incremental, err := l.Backup(filepath.Join(root, "backup-2"), filepath.Join(root, "backup-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incremental.Copied == 0 || incremental.Copied >= incremental.Tables {
+		t.Fatalf("incremental backup = %+v, full %+v", incremental, full)
+	}
+	shared := 0
+	entries, err := os.ReadDir(filepath.Join(root, "backup-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		a, errA := os.Stat(filepath.Join(root, "backup-1", e.Name()))
+		b, errB := os.Stat(filepath.Join(root, "backup-2", e.Name()))
+		if errA == nil && errB == nil && strings.HasSuffix(e.Name(), ".sst") && os.SameFile(a, b) {
+			shared++
+		}
+	}
+	if shared != incremental.Tables-incremental.Copied {
+		t.Fatalf("%d tables shared with the earlier backup, want %d", shared, incremental.Tables-incremental.Copied)
+	}
+
+	check(checkpoint, 4)
+	check(filepath.Join(root, "backup-1"), 4)
+	check(filepath.Join(root, "backup-2"), 5)
+
+	vopts := DefaultOptions()
+	vopts.ValueLogThreshold = 16
+	vl, err := Open(filepath.Join(root, "values"), vopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vl.Close()
+	if err := vl.Put("a", strPtr(strings.Repeat("a", 64))); err != nil {
+		t.Fatal(err)
+	}
+	vcheckpoint := filepath.Join(root, "values-checkpoint")
+	if err := vl.Checkpoint(vcheckpoint); err != nil {
+		t.Fatal(err)
+	}
+	vlogSizes := func() map[string]int64 {
+		t.Helper()
+		names, err := filepath.Glob(filepath.Join(vcheckpoint, "vlog-*.log"))
+		if err != nil || len(names) == 0 {
+			t.Fatalf("checkpoint value logs = %v, %v", names, err)
+		}
+		sizes := make(map[string]int64)
+		for _, name := range names {
+			st, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[name] = st.Size()
+		}
+		return sizes
+	}
+	want := vlogSizes()
+	if err := vl.Put("b", strPtr(strings.Repeat("b", 64))); err != nil {
+		t.Fatal(err)
+	}
+	if err := vl.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := vlogSizes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("checkpoint value logs grew after later writes: %v, want %v", got, want)
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.PutWithTTL("short", "v", 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.PutWithTTL("long", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	b := NewWriteBatch()
+	b.PutWithTTL("batched", "v", 300*time.Millisecond)
+	b.Put("plain", strPtr("v"))
+	if err := l.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := collect(l.Range("", "", false)); !reflect.DeepEqual(got, []string{"batched=v", "long=v", "plain=v", "short=v"}) {
+		t.Fatalf("scan before expiry = %v", got)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if got := l.Get("short"); got != nil {
+		t.Fatalf("Get(short) after expiry = %q", *got)
+	}
+	if got := collect(l.Range("", "", false)); !reflect.DeepEqual(got, []string{"long=v", "plain=v"}) {
+		t.Fatalf("scan after expiry = %v", got)
+	}
+
+	if err := l.Put("z", strPtr("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	entries := 0
+	for _, level := range l.files {
+		for _, table := range level {
+			entries += table.keyCount
+		}
+	}
+	if entries != 3 {
+		t.Fatalf("%d entries after compacting expired keys, want 3: %v", entries, layoutOf(l))
+	}
+
+	walDir := t.TempDir()
+	crashed := openTestLSM(t, walDir, 1<<20)
+	if err := crashed.PutWithTTL("k", "v", 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	recovered := openTestLSM(t, walDir, 1<<20)
+	if got := recovered.Get("k"); got == nil || *got != "v" {
+		t.Fatalf("Get(k) after WAL replay = %v, want v", got)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if got := recovered.Get("k"); got != nil {
+		t.Fatalf("Get(k) replayed from the WAL = %q after expiry", *got)
+	}
+}
+
+type prefixFilter struct{}
+
+func (prefixFilter) Name() string { return "prefix" }
+
+func (prefixFilter) Filter(level int, key string, value string) (FilterDecision, string) {
+	switch {
+	case strings.HasPrefix(value, "stale"):
+		return FilterRemove, ""
+	case strings.HasPrefix(value, "old"):
+		return FilterChange, "new" + strings.TrimPrefix(value, "old")
+	}
+	return FilterKeep, ""
+}
+
+func TestCompactionFilter(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	opts.CompactionFilter = prefixFilter{}
+	l, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, kv := range [][2]string{{"a", "stale-1"}, {"b", "old-1"}, {"c", "keep"}, {"d", "stale-2"}} {
+		if err := l.Put(kv[0], strPtr(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := l.Snapshot()
+	defer snap.Release()
+	if err := l.Put("e", strPtr("stale-3")); err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 2; round++ {
+		if err := l.Put("f", strPtr(fmt.Sprint(round))); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(l.files) < 2 || len(l.files[1]) == 0 {
+		t.Fatalf("expected data in L1, layout %v", layoutOf(l))
+	}
+	if got, want := collect(l.Range("", "", false)), []string{"a=stale-1", "b=old-1", "c=keep", "d=stale-2", "f=1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("scan with snapshot held = %v, want %v", got, want)
+	}
+	if got := snap.Get("a"); got == nil || *got != "stale-1" {
+		t.Fatalf("snapshot Get(a) = %v, want stale-1", got)
+	}
+
+	snap.Release()
+	for round := 0; round < 2; round++ {
+		if err := l.Put("c", strPtr(fmt.Sprintf("keep-%d", round))); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := collect(l.Range("", "", false)), []string{"b=new-1", "c=keep-1", "f=1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("scan after release = %v, want %v", got, want)
+	}
+}
+
+func TestIngest(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db")
+	opts := DefaultOptions()
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, keys []string, value string) string {
+		t.Helper()
+		path := filepath.Join(root, name)
+		w, err := NewSSTableWriter(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := w.Put(k, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	w, err := NewSSTableWriter(filepath.Join(root, "bad.sst"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put("b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put("a", "1"); !errors.Is(err, errIngestKeyOrder) {
+		t.Fatalf("out of order Put = %v", err)
+	}
+	w.Abort()
+
+	if err := l.Put("k05", strPtr("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("a", strPtr("a")); err != nil {
+		t.Fatal(err)
+	}
+	snap := l.Snapshot()
+	defer snap.Release()
+
+	var low, high []string
+	for i := 0; i < 10; i++ {
+		low = append(low, fmt.Sprintf("k%02d", i))
+		high = append(high, fmt.Sprintf("m%02d", i))
+	}
+	if err := l.Ingest(write("overlap-a.sst", low, "x"), write("overlap-b.sst", []string{"k09", "k10"}, "x")); !errors.Is(err, errIngestOverlap) {
+		t.Fatalf("overlapping ingest = %v", err)
+	}
+	if err := l.Ingest(write("low.sst", low, "new"), write("high.sst", high, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("k05"); got == nil || *got != "new" {
+		t.Fatalf("Get(k05) = %v, want ingested value", got)
+	}
+	if got := snap.Get("k05"); got == nil || *got != "old" {
+		t.Fatalf("snapshot Get(k05) = %v, want old", got)
+	}
+	if got := snap.Get("m05"); got != nil {
+		t.Fatalf("snapshot sees ingested key m05 = %q", *got)
+	}
+	if got := l.Get("a"); got == nil || *got != "a" {
+		t.Fatalf("Get(a) = %v", got)
+	}
+
+	l.mutex.RLock()
+	var deep bool
+	for level := 1; level < len(l.files); level++ {
+		for _, f := range l.files[level] {
+			deep = deep || f.hasGlobalSeq && f.minKey == "m00"
+		}
+	}
+	l.mutex.RUnlock()
+	if !deep {
+		t.Fatal("non-overlapping ingested file was not placed below level 0")
+	}
+
+	if err := l.Put("m03", strPtr("newer")); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, k := range append(low, high...) {
+		want := "new"
+		if k == "m03" {
+			want = "newer"
+		}
+		if got := l.Get(k); got == nil || *got != want {
+			t.Fatalf("after reopen Get(%s) = %v, want %s", k, got, want)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("m03"); got == nil || *got != "newer" {
+		t.Fatalf("after compaction Get(m03) = %v", got)
+	}
+	if got := l.Get("k05"); got == nil || *got != "new" {
+		t.Fatalf("after compaction Get(k05) = %v", got)
+	}
+}
+
+func TestOpenTablesAndScan(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("a", strPtr("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.PutWithTTL("b", "2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	levels, err := OpenTables(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []*SSTable
+	for _, level := range levels {
+		tables = append(tables, level...)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("OpenTables returned %d tables, want 1", len(tables))
+	}
+	defer tables[0].Close()
+	info := tables[0].Info()
+	if info.Format != sstFormatValueLog || info.KeyCount != 3 || info.MinKey != "a" || info.MaxKey != "c" || info.BloomHashes == 0 {
+		t.Fatalf("Info() = %+v", info)
+	}
+
+	var got []string
+	err = tables[0].Scan(func(e Entry) error {
+		s := e.Key + " " + e.Kind
+		if e.Value != nil {
+			s += " " + *e.Value
+		}
+		if !e.ExpiresAt.IsZero() {
+			s += " ttl"
+		}
+		got = append(got, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a put 1", "b put 2 ttl", "c delete"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Scan = %q, want %q", got, want)
+	}
+}
+
+func TestOpenTablesWithoutManifestResolvesValueLog(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.ValueLogThreshold = 16
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("v", 64)
+	if err := l.Put("big", &big); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("small", strPtr("s")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, manifestFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	levels, err := OpenTables(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []*SSTable
+	for _, level := range levels {
+		tables = append(tables, level...)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("OpenTables without a manifest returned %d tables, want 1", len(tables))
+	}
+	defer tables[0].Close()
+	got := make(map[string]string)
+	err = tables[0].Scan(func(e Entry) error {
+		if e.Key == "big" && (e.ValueLog == "" || e.Value != nil) {
+			t.Fatalf("big entry = %+v, want a value log pointer", e)
+		}
+		if err := tables[0].ResolveValue(&e); err != nil {
+			return err
+		}
+		got[e.Key] = *e.Value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"big": big, "small": "s"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("resolved values = %q, want %q", got, want)
+	}
+}
+
+func TestPrefixCompressedBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefixed.sst")
+	w, err := newSSTWriter(path, tableOptions{blockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	keyBytes := 0
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("internationalization-%04d", i)
+		keys = append(keys, key)
+		versions := 1
+		if i%50 == 7 {
+			versions = 3 * blockRestartInterval
+		}
+		for v := versions; v > 0; v-- {
+			if err := w.add(key, VersionedValue{value: strPtr(fmt.Sprintf("%d/%d", i, v)), sequenceNumber: uint32(v), kind: kindPut}); err != nil {
+				t.Fatal(err)
+			}
+			keyBytes += len(key)
+		}
+	}
+	s, err := w.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.size >= uint64(keyBytes) {
+		t.Fatalf("table is %d bytes, keys alone are %d bytes uncompressed", s.size, keyBytes)
+	}
+
+	for i, key := range keys {
+		versions, err := s.getVersions(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if i%50 == 7 {
+			want = 3 * blockRestartInterval
+		}
+		if len(versions) != want || *versions[0].value != fmt.Sprintf("%d/%d", i, want) {
+			t.Fatalf("getVersions(%s) returned %d versions, newest %v", key, len(versions), *versions[0].value)
+		}
+	}
+	if versions, err := s.getVersions("internationalization-0100x"); err != nil || len(versions) != 0 {
+		t.Fatalf("absent key = %v, %v", versions, err)
+	}
+
+	it := s.newIterator(true)
+	it.seek("internationalization-0250")
+	if !it.valid() || it.key() != "internationalization-0250" {
+		t.Fatalf("reverse seek landed on %v", it.valid())
+	}
+	damaged, err := s.verify()
+	if err != nil || len(damaged) > 0 {
+		t.Fatalf("verify = %v, %v", damaged, err)
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFilesPerLevel = 1
+	opts.ValueLogThreshold = 64
+	opts.ValueLogFileSize = 8 << 10
+	opts.MergeOperator = RoaringUnion{}
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := func(round, i int) string {
+		return strings.Repeat(fmt.Sprintf("%d-%03d|", round, i), 40)
+	}
+	vlogFiles := func() int {
+		t.Helper()
+		names, err := filepath.Glob(filepath.Join(dir, "vlog-*.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(names)
+	}
+	check := func(l *LSM, round int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			want := big(0, i)
+			if i%2 == 0 {
+				want = big(round, i)
+			}
+			if got := l.Get(key); got == nil || *got != want {
+				t.Fatalf("Get(%s) = %v", key, got)
+			}
+		}
+		if got := l.Get("small"); got == nil || *got != "inline" {
+			t.Fatalf("Get(small) = %v", got)
+		}
+		ids := make([]uint32, 300)
+		for i := range ids {
+			ids[i] = uint32(i * 3)
+		}
+		if got := l.Get("bitmap"); got == nil || *got != *bitmapValue(append(ids, 1)...) {
+			t.Fatal("merge operand was not applied to a separated base value")
+		}
+		it := l.Prefix("key", false)
+		n := 0
+		for ; it.Valid(); it.Next() {
+			n++
+		}
+		if err := it.Close(); err != nil || n != 100 {
+			t.Fatalf("iterated %d keys, err %v", n, err)
+		}
+	}
+
+	var valueBytes int
+	for i := 0; i < 100; i++ {
+		v := big(0, i)
+		valueBytes += len(v)
+		if err := l.Put(fmt.Sprintf("key%03d", i), &v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Put("small", strPtr("inline")); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint32, 300)
+	for i := range ids {
+		ids[i] = uint32(i * 3)
+	}
+	if err := l.Put("bitmap", bitmapValue(ids...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Merge("bitmap", *bitmapValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	if vlogFiles() < 2 {
+		t.Fatalf("expected values spread over several value log files, got %d", vlogFiles())
+	}
+	var tableBytes uint64
+	l.mutex.RLock()
+	for _, level := range l.files {
+		tableBytes += tablesBytes(level)
+	}
+	l.mutex.RUnlock()
+	if tableBytes*4 > uint64(valueBytes) {
+		t.Fatalf("tables hold %d bytes for %d bytes of values", tableBytes, valueBytes)
+	}
+
+	for round := 1; round <= 3; round++ {
+		for i := 0; i < 100; i += 2 {
+			v := big(round, i)
+			if err := l.Put(fmt.Sprintf("key%03d", i), &v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(l, 3)
+
+	res, err := l.CollectValueLog(0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FilesCollected == 0 || res.BytesReclaimed == 0 || res.TablesRewritten == 0 {
+		t.Fatalf("CollectValueLog = %+v", res)
+	}
+	check(l, 3)
+
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	backup, err := l.Backup(backupDir, "")
+	if err != nil || backup.ValueLogs == 0 {
+		t.Fatalf("Backup = %+v, %v", backup, err)
+	}
+	restored, err := Open(backupDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(restored, 3)
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	check(l, 3)
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(l, 3)
+
+	l0Dir := t.TempDir()
+	opts.MaxFilesPerLevel = 10
+	opts.MergeOperator = LastWriteWins{}
+	l0, err := Open(l0Dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{big(0, 0), "new"} {
+		if err := l0.Put("k", &v); err != nil {
+			t.Fatal(err)
+		}
+		if err := l0.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := l0.CollectValueLog(0); err != nil || res.TablesRewritten == 0 {
+		t.Fatalf("CollectValueLog = %+v, %v", res, err)
+	}
+	want := layoutOf(l0)
+	if err := l0.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l0, err = Open(l0Dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer l0.Close()
+	if got := layoutOf(l0); !reflect.DeepEqual(got, want) {
+		t.Fatalf("L0 after rewrite and reopen = %v, want %v", got, want)
+	}
+	if got := l0.Get("k"); got == nil || *got != "new" {
+		t.Fatalf("Get(k) after rewrite and reopen = %v, want new", got)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	mem := NewMemFS()
+	opts := DefaultOptions()
+	opts.FS = mem
+	opts.MaxSize = 1024
+	opts.MaxFilesPerLevel = 2
+	opts.ValueLogThreshold = 64
+	dir := "/db/main"
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := func(i int) string { return strings.Repeat(fmt.Sprintf("%03d", i), i%40) }
+	for i := 0; i < 300; i++ {
+		if err := l.Put(fmt.Sprintf("key%03d", i), strPtr(value(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Checkpoint("/db/checkpoint"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Stat(%s) on the real filesystem = %v, want not exist", dir, err)
+	}
+
+	entries, err := mem.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables, vlogs int
+	for _, e := range entries {
+		switch {
+		case strings.HasSuffix(e.Name(), ".sst"):
+			tables++
+		case strings.HasPrefix(e.Name(), "vlog-"):
+			vlogs++
+		}
+	}
+	if tables == 0 || vlogs == 0 {
+		t.Fatalf("MemFS holds %d tables and %d value logs, want both", tables, vlogs)
+	}
+
+	for _, d := range []string{dir, "/db/checkpoint"} {
+		reopened, err := Open(d, opts)
+		if err != nil {
+			t.Fatalf("Open(%s): %v", d, err)
+		}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if got := reopened.Get(key); got == nil || *got != value(i) {
+				t.Fatalf("%s: Get(%s) = %v, want %q", d, key, got, value(i))
+			}
+		}
+		if err := reopened.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALTornAppend(t *testing.T) {
+	mem := NewMemFS()
+	ffs := NewFaultFS(mem)
+	opts := DefaultOptions()
+	opts.FS = ffs
+	opts.Sync = SyncEveryWrite
+	l, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("a", strPtr("va")); err != nil {
+		t.Fatal(err)
+	}
+	ffs.TearWritesAfter(5)
+	if err := l.Put("b", strPtr("vb")); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("Put during torn write = %v, want injected fault", err)
+	}
+	ffs.TearWritesAfter(-1)
+	if err := l.Put("c", strPtr("vc")); err != nil {
+		t.Fatalf("Put after torn write: %v", err)
+	}
+	ffs.Crash()
+	_ = l.Close()
+	if err := ffs.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for key, want := range map[string]*string{"a": strPtr("va"), "b": nil, "c": strPtr("vc")} {
+		if got := reopened.Get(key); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Get(%s) after replay = %v, want %v", key, got, want)
+		}
+	}
+}
+
+type concatMerge struct{}
+
+func (concatMerge) Name() string { return "concat" }
+
+func (concatMerge) Merge(key string, existing *string, operands []string) (string, error) {
+	var out string
+	if existing != nil {
+		out = *existing
+	}
+	return out + strings.Join(operands, ""), nil
+}
+
+func TestWALReplaySkipsFlushedSegments(t *testing.T) {
+	mem := NewMemFS()
+	ffs := NewFaultFS(mem)
+	opts := DefaultOptions()
+	opts.FS = ffs
+	opts.Sync = SyncEveryWrite
+	opts.MergeOperator = concatMerge{}
+	l, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Merge("k", "a"); err != nil {
+		t.Fatal(err)
+	}
+	ffs.FailOn(func(op, name string) bool {
+		return op == "remove" && strings.HasPrefix(filepath.Base(name), "wal-")
+	})
+	if err := l.Compact(); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("Compact = %v, want injected fault", err)
+	}
+	ffs.Crash()
+	_ = l.Close()
+	if err := ffs.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Get("k"); got == nil || *got != "a" {
+		t.Fatalf("Get(k) after replay = %v, want a", got)
+	}
+	if err := reopened.Merge("k", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := reopened.Get("k"); got == nil || *got != "ab" {
+		t.Fatalf("Get(k) after second reopen = %v, want ab", got)
+	}
+}
+
+func TestCompactionSyncsDirBeforeManifestEdit(t *testing.T) {
+	ffs := NewFaultFS(NewMemFS())
+	opts := DefaultOptions()
+	opts.FS = ffs
+	opts.Sync = SyncEveryWrite
+	opts.MaxFilesPerLevel = 1
+	l, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	put := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := l.Put(fmt.Sprintf("key%04d", i), strPtr(fmt.Sprintf("v%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 200)
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	put(100, 300)
+
+	var ops []string
+	ffs.FailOn(func(op, name string) bool {
+		ops = append(ops, op+" "+filepath.Base(name))
+		return false
+	})
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	ffs.FailOn(nil)
+
+	var outputs int
+	unsynced := false
+	for _, op := range ops {
+		switch {
+		case strings.HasPrefix(op, "sync L1-"):
+			outputs++
+			unsynced = true
+		case strings.HasPrefix(op, "syncdir "):
+			unsynced = false
+		case strings.HasPrefix(op, "write "+manifestFileName) && unsynced:
+			t.Fatalf("manifest edit logged before the directory was synced: %v", ops)
+		}
+	}
+	if outputs == 0 {
+		t.Fatalf("no compaction output was written: %v", ops)
+	}
+}
+
+func TestGetDoesNotWaitForWALSync(t *testing.T) {
+	ffs := NewFaultFS(NewMemFS())
+	opts := DefaultOptions()
+	opts.FS = ffs
+	opts.Sync = SyncEveryWrite
+	l, err := Open("/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Put("a", strPtr("va")); err != nil {
+		t.Fatal(err)
+	}
+
+	syncing, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	ffs.FailOn(func(op, name string) bool {
+		if op == "sync" && strings.HasPrefix(filepath.Base(name), "wal-") {
+			once.Do(func() { close(syncing) })
+			<-release
+		}
+		return false
+	})
+	done := make(chan error)
+	go func() { done <- l.Put("b", strPtr("vb")) }()
+	<-syncing
+
+	got := make(chan [2]*string)
+	go func() { got <- [2]*string{l.Get("a"), l.Get("b")} }()
+	select {
+	case v := <-got:
+		if v[0] == nil || *v[0] != "va" || v[1] != nil {
+			t.Fatalf("Get during a WAL sync = %v, %v; want va and an unpublished b", v[0], v[1])
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("Get blocked behind a WAL sync")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	ffs.FailOn(nil)
+	if got := l.Get("b"); got == nil || *got != "vb" {
+		t.Fatalf("Get(b) after the write = %v, want vb", got)
+	}
+}
+
+func TestFaultFSPowerLoss(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		inject func(f *FaultFS)
+	}{
+		{"flush", func(f *FaultFS) { f.TearWritesAfter(100) }},
+		{"merge", func(f *FaultFS) {
+			f.FailOn(func(op, name string) bool {
+				return op == "write" && strings.HasPrefix(filepath.Base(name), "L1-")
+			})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := NewMemFS()
+			ffs := NewFaultFS(mem)
+			opts := DefaultOptions()
+			opts.FS = ffs
+			opts.Sync = SyncEveryWrite
+			opts.MaxFilesPerLevel = 1
+			dir := "/db"
+			l, err := Open(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			put := func(from, to int) {
+				t.Helper()
+				for i := from; i < to; i++ {
+					if err := l.Put(fmt.Sprintf("key%04d", i), strPtr(fmt.Sprintf("v%d", i))); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			put(0, 500)
+			if err := l.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			put(250, 1000)
+
+			tc.inject(ffs)
+			if err := l.Compact(); !errors.Is(err, ErrInjectedFault) {
+				t.Fatalf("Compact = %v, want injected fault", err)
+			}
+			ffs.Crash()
+			_ = l.Close()
+			if err := ffs.Restart(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := Open(dir, opts)
+			if err != nil {
+				t.Fatalf("Open after power loss: %v", err)
+			}
+			defer reopened.Close()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key%04d", i)
+				if got := reopened.Get(key); got == nil || *got != fmt.Sprintf("v%d", i) {
+					t.Fatalf("Get(%s) after power loss = %v", key, got)
+				}
+			}
+			if err := reopened.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			live := make(map[string]bool)
+			reopened.mutex.RLock()
+			for _, level := range reopened.files {
+				for _, table := range level {
+					live[filepath.Base(table.Path())] = true
+				}
+			}
+			reopened.mutex.RUnlock()
+			entries, err := mem.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasSuffix(e.Name(), ".sst") && !live[e.Name()] {
+					t.Fatalf("torn table %s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
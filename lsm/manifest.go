@@ -0,0 +1,448 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const manifestFileName = "MANIFEST"
+
+var errBadManifestEdit = errors.New("manifest: malformed version edit")
+
+type manifestTable struct {
+	level     int
+	name      string
+	globalSeq uint32
+	ingested  bool
+	replaces  string
+}
+
+type versionEdit struct {
+	added          []manifestTable
+	deleted        []string
+	nextFileID     uint64
+	sequenceNumber uint32
+	flushedWAL     uint64
+}
+
+type manifest struct {
+	f File
+}
+
+type manifestState struct {
+	found          bool
+	levels         [][]string
+	globalSeqs     map[string]uint32
+	nextFileID     uint64
+	sequenceNumber uint32
+	flushedWAL     uint64
+}
+
+func (e versionEdit) encode() []byte {
+	b := binary.LittleEndian.AppendUint64(nil, e.nextFileID)
+	b = binary.LittleEndian.AppendUint32(b, e.sequenceNumber)
+	b = binary.AppendUvarint(b, uint64(len(e.added)))
+	for _, t := range e.added {
+		b = binary.AppendUvarint(b, uint64(t.level))
+		b = binary.AppendUvarint(b, uint64(len(t.name)))
+		b = append(b, t.name...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(e.deleted)))
+	for _, name := range e.deleted {
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+	}
+
+	var ingested, replacing []manifestTable
+	for _, t := range e.added {
+		if t.ingested {
+			ingested = append(ingested, t)
+		}
+		if t.replaces != "" {
+			replacing = append(replacing, t)
+		}
+	}
+	if len(ingested) == 0 && len(replacing) == 0 && e.flushedWAL == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(len(ingested)))
+	for _, t := range ingested {
+		b = binary.AppendUvarint(b, uint64(len(t.name)))
+		b = append(b, t.name...)
+		b = binary.LittleEndian.AppendUint32(b, t.globalSeq)
+	}
+	if len(replacing) == 0 && e.flushedWAL == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(len(replacing)))
+	for _, t := range replacing {
+		b = binary.AppendUvarint(b, uint64(len(t.name)))
+		b = append(b, t.name...)
+		b = binary.AppendUvarint(b, uint64(len(t.replaces)))
+		b = append(b, t.replaces...)
+	}
+	if e.flushedWAL == 0 {
+		return b
+	}
+	return binary.AppendUvarint(b, e.flushedWAL)
+}
+
+func decodeVersionEdit(b []byte) (versionEdit, error) {
+	var e versionEdit
+	if len(b) < 12 {
+		return e, errBadManifestEdit
+	}
+	e.nextFileID = binary.LittleEndian.Uint64(b[0:8])
+	e.sequenceNumber = binary.LittleEndian.Uint32(b[8:12])
+	b = b[12:]
+
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errBadManifestEdit
+		}
+		b = b[n:]
+		return v, nil
+	}
+	readString := func() (string, error) {
+		n, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if uint64(len(b)) < n {
+			return "", errBadManifestEdit
+		}
+		s := string(b[:n])
+		b = b[n:]
+		return s, nil
+	}
+
+	added, err := readUvarint()
+	if err != nil {
+		return e, err
+	}
+	for i := uint64(0); i < added; i++ {
+		level, err := readUvarint()
+		if err != nil {
+			return e, err
+		}
+		name, err := readString()
+		if err != nil {
+			return e, err
+		}
+		e.added = append(e.added, manifestTable{level: int(level), name: name})
+	}
+	deleted, err := readUvarint()
+	if err != nil {
+		return e, err
+	}
+	for i := uint64(0); i < deleted; i++ {
+		name, err := readString()
+		if err != nil {
+			return e, err
+		}
+		e.deleted = append(e.deleted, name)
+	}
+	if len(b) == 0 {
+		return e, nil
+	}
+
+	ingested, err := readUvarint()
+	if err != nil {
+		return e, err
+	}
+	for i := uint64(0); i < ingested; i++ {
+		name, err := readString()
+		if err != nil {
+			return e, err
+		}
+		if len(b) < 4 {
+			return e, errBadManifestEdit
+		}
+		seq := binary.LittleEndian.Uint32(b[0:4])
+		b = b[4:]
+		for j := range e.added {
+			if e.added[j].name == name {
+				e.added[j].globalSeq = seq
+				e.added[j].ingested = true
+			}
+		}
+	}
+	if len(b) == 0 {
+		return e, nil
+	}
+
+	replacing, err := readUvarint()
+	if err != nil {
+		return e, err
+	}
+	for i := uint64(0); i < replacing; i++ {
+		name, err := readString()
+		if err != nil {
+			return e, err
+		}
+		old, err := readString()
+		if err != nil {
+			return e, err
+		}
+		for j := range e.added {
+			if e.added[j].name == name {
+				e.added[j].replaces = old
+			}
+		}
+	}
+	if len(b) == 0 {
+		return e, nil
+	}
+
+	e.flushedWAL, err = readUvarint()
+	return e, err
+}
+
+func (s *manifestState) apply(e versionEdit) {
+	inPlace := make(map[string]bool)
+	for _, t := range e.added {
+		if t.replaces == "" || t.level >= len(s.levels) {
+			continue
+		}
+		for i, n := range s.levels[t.level] {
+			if n == t.replaces {
+				s.levels[t.level][i] = t.name
+				inPlace[t.name] = true
+				break
+			}
+		}
+	}
+	for _, name := range e.deleted {
+		delete(s.globalSeqs, name)
+		for level, names := range s.levels {
+			for i, n := range names {
+				if n == name {
+					s.levels[level] = append(names[:i:i], names[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	for _, t := range e.added {
+		for len(s.levels) <= t.level {
+			s.levels = append(s.levels, nil)
+		}
+		if !inPlace[t.name] {
+			s.levels[t.level] = append(s.levels[t.level], t.name)
+		}
+		if t.ingested {
+			if s.globalSeqs == nil {
+				s.globalSeqs = make(map[string]uint32)
+			}
+			s.globalSeqs[t.name] = t.globalSeq
+		}
+	}
+	if e.nextFileID > s.nextFileID {
+		s.nextFileID = e.nextFileID
+	}
+	if e.sequenceNumber > s.sequenceNumber {
+		s.sequenceNumber = e.sequenceNumber
+	}
+	if e.flushedWAL > s.flushedWAL {
+		s.flushedWAL = e.flushedWAL
+	}
+}
+
+func readManifest(fs FS, dir string) (manifestState, error) {
+	var state manifestState
+	f, err := fs.Open(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	defer f.Close()
+	state.found = true
+	err = readLogRecordsStrict(f, func(payload []byte) error {
+		e, err := decodeVersionEdit(payload)
+		if err != nil {
+			return err
+		}
+		state.apply(e)
+		return nil
+	})
+	var recErr *logRecordError
+	switch {
+	case errors.As(err, &recErr):
+		return manifestState{}, &CorruptionError{Path: filepath.Join(dir, manifestFileName), Offset: recErr.Offset, Err: errChecksumMismatch}
+	case errors.Is(err, errBadManifestEdit):
+		return manifestState{}, &CorruptionError{Path: filepath.Join(dir, manifestFileName), Err: err}
+	}
+	return state, err
+}
+
+func scanTableFiles(fs FS, dir string) (manifestState, error) {
+	var state manifestState
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return state, err
+	}
+	type tableFile struct {
+		name  string
+		level int
+		id    uint64
+	}
+	var tables []tableFile
+	for _, e := range entries {
+		if level, id, ok := parseTableFileName(e.Name()); ok {
+			tables = append(tables, tableFile{name: e.Name(), level: level, id: id})
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].id < tables[j].id })
+	for _, t := range tables {
+		state.apply(versionEdit{added: []manifestTable{{level: t.level, name: t.name}}, nextFileID: t.id + 1})
+	}
+	return state, nil
+}
+
+func parseTableFileName(name string) (level int, id uint64, ok bool) {
+	if !strings.HasPrefix(name, "L") || !strings.HasSuffix(name, ".sst") {
+		return 0, 0, false
+	}
+	levelStr, idStr, found := strings.Cut(strings.TrimSuffix(name[1:], ".sst"), "-")
+	if !found {
+		return 0, 0, false
+	}
+	level, err := strconv.Atoi(levelStr)
+	if err != nil || level < 0 {
+		return 0, 0, false
+	}
+	if id, err = strconv.ParseUint(idStr, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	return level, id, true
+}
+
+func createManifest(fs FS, dir string, snapshot versionEdit) (*manifest, error) {
+	tmp := filepath.Join(dir, manifestFileName+".tmp")
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := appendLogRecord(f, snapshot.encode()); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := fs.Rename(tmp, filepath.Join(dir, manifestFileName)); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &manifest{f: f}, nil
+}
+
+func (m *manifest) logEdit(e versionEdit) error {
+	if err := appendLogRecord(m.f, e.encode()); err != nil {
+		return err
+	}
+	return m.f.Sync()
+}
+
+func (m *manifest) close() error {
+	if m.f == nil {
+		return nil
+	}
+	err := m.f.Close()
+	m.f = nil
+	return err
+}
+
+func (l *LSM) adoptTablesLocked() error {
+	var demoted []*SSTable
+	for level := len(l.files) - 1; level > 0; level-- {
+		sorted := append([]*SSTable(nil), l.files[level]...)
+		sortByMinKey(sorted)
+		if !tablesOverlap(sorted) {
+			l.files[level] = sorted
+			continue
+		}
+		demoted = append(demoted, l.files[level]...)
+		l.files[level] = nil
+	}
+	if len(demoted) > 0 {
+		l.ensureLevelLocked(0)
+		l.files[0] = append(demoted, l.files[0]...)
+	}
+
+	for _, tables := range l.files {
+		for _, t := range tables {
+			seq, err := t.maxSequence()
+			if err != nil {
+				return err
+			}
+			if seq >= l.sequenceNumber {
+				l.sequenceNumber = seq + 1
+			}
+			for _, id := range t.valueFiles {
+				if id >= l.nextFileID {
+					l.nextFileID = id + 1
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func tablesOverlap(sorted []*SSTable) bool {
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].minKey <= sorted[i-1].maxKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SSTable) maxSequence() (uint32, error) {
+	var seq uint32
+	it := s.newIterator(false)
+	for it.first(); it.valid(); it.next() {
+		v, err := it.value()
+		if err != nil {
+			return 0, err
+		}
+		seq = max(seq, v.sequenceNumber)
+	}
+	return seq, it.err()
+}
+
+func removeStrayFiles(fs FS, dir string, live map[string]bool) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		name := e.Name()
+		stray := strings.HasPrefix(name, "sst-") && strings.HasSuffix(name, ".tmp")
+		if live != nil && strings.HasSuffix(name, ".sst") && !live[name] {
+			stray = true
+		}
+		if !stray {
+			continue
+		}
+		if err := fs.Remove(filepath.Join(dir, name)); err != nil {
+			errs = append(errs, fmt.Errorf("remove %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
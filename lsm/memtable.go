@@ -1,14 +1,49 @@
 package lsm
 
-import "sort"
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type valueKind uint8
+
+const (
+	kindDelete valueKind = iota
+	kindPut
+	kindMerge
+	kindPutExpiring
+	kindPutPointer
+)
+
+const (
+	skiplistMaxHeight = 12
+	skiplistBranching = 4
+)
 
 type VersionedValue struct {
 	value          *string
 	sequenceNumber uint32
+	kind           valueKind
+	expiresAt      int64
+	pointer        *valuePointer
+}
+
+func expiryAfter(ttl time.Duration) int64 {
+	return time.Now().Add(ttl).UnixNano()
+}
+
+func (v VersionedValue) expired(now int64) bool {
+	return v.kind == kindPut && v.expiresAt != 0 && v.expiresAt <= now
 }
 
 type MemTable struct {
-	values map[string]VersionedValue
+	head   *skiplistNode
+	height atomic.Int32
+	size   atomic.Int64
+	count  atomic.Int64
+	mu     sync.Mutex
 }
 
 type MemTableEntry struct {
@@ -16,49 +51,260 @@ type MemTableEntry struct {
 	Value VersionedValue
 }
 
-func NewMemTable() *MemTable {
-	return &MemTable{
-		values: make(map[string]VersionedValue),
+type skiplistNode struct {
+	key      string
+	versions atomic.Pointer[[]VersionedValue]
+	next     []atomic.Pointer[skiplistNode]
+}
+
+func newSkiplistNode(key string, height int) *skiplistNode {
+	return &skiplistNode{key: key, next: make([]atomic.Pointer[skiplistNode], height)}
+}
+
+func (n *skiplistNode) loadVersions() []VersionedValue {
+	if p := n.versions.Load(); p != nil {
+		return *p
 	}
+	return nil
+}
+
+func NewMemTable() *MemTable {
+	t := &MemTable{head: newSkiplistNode("", skiplistMaxHeight)}
+	t.height.Store(1)
+	return t
 }
 
 func (t *MemTable) Put(key string, value *string, sequence uint32) {
+	kind := kindPut
 	if value == nil {
-		t.values[key] = VersionedValue{value: nil, sequenceNumber: sequence}
-		return
+		kind = kindDelete
 	}
-	if prev, ok := t.values[key]; ok && prev.value != nil {
-		merged, err := mergeTwoRoaringStrings(prev.value, value)
-		if err == nil {
-			seq := prev.sequenceNumber
-			if sequence > seq {
-				seq = sequence
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	versions, _ := t.prepare(key, VersionedValue{value: value, sequenceNumber: sequence, kind: kind}, nil, LastWriteWins{})
+	t.set(key, versions)
+}
+
+func (t *MemTable) Merge(key string, operand string, sequence uint32, op MergeOperator) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	versions, err := t.prepare(key, VersionedValue{value: &operand, sequenceNumber: sequence, kind: kindMerge}, nil, op)
+	if err != nil {
+		return err
+	}
+	t.set(key, versions)
+	return nil
+}
+
+func (t *MemTable) prepare(key string, v VersionedValue, snapshots []uint32, op MergeOperator) ([]VersionedValue, error) {
+	return prependVersion(key, t.versions(key), v, snapshots, op)
+}
+
+func prependVersion(key string, prev []VersionedValue, v VersionedValue, snapshots []uint32, op MergeOperator) ([]VersionedValue, error) {
+	versions := make([]VersionedValue, 0, len(prev)+1)
+	versions = append(append(versions, v), prev...)
+	return collapseVersions(key, versions, snapshots, op, false)
+}
+
+func (t *MemTable) set(key string, versions []VersionedValue) {
+	var prev [skiplistMaxHeight]*skiplistNode
+	n := t.findGreaterOrEqual(key, &prev)
+	if n == nil || n.key != key {
+		height := randomHeight()
+		if h := int(t.height.Load()); height > h {
+			for i := h; i < height; i++ {
+				prev[i] = t.head
 			}
-			t.values[key] = VersionedValue{value: merged, sequenceNumber: seq}
-			return
+			t.height.Store(int32(height))
+		}
+		n = newSkiplistNode(key, height)
+		for i := 0; i < height; i++ {
+			n.next[i].Store(prev[i].next[i].Load())
+		}
+		t.account(key, nil, versions)
+		n.versions.Store(&versions)
+		for i := 0; i < height; i++ {
+			prev[i].next[i].Store(n)
+		}
+		return
+	}
+	t.account(key, n.loadVersions(), versions)
+	n.versions.Store(&versions)
+}
+
+func (t *MemTable) account(key string, old, versions []VersionedValue) {
+	t.size.Add(versionsSize(key, versions) - versionsSize(key, old))
+	t.count.Add(int64(len(versions) - len(old)))
+}
+
+func versionsSize(key string, versions []VersionedValue) int64 {
+	var n int64
+	for _, v := range versions {
+		n += int64(len(key))
+		if v.value != nil {
+			n += int64(len(*v.value))
 		}
 	}
-	t.values[key] = VersionedValue{value: value, sequenceNumber: sequence}
+	return n
+}
+
+func randomHeight() int {
+	h := 1
+	for h < skiplistMaxHeight && rand.Uint32()%skiplistBranching == 0 {
+		h++
+	}
+	return h
+}
+
+func (t *MemTable) findGreaterOrEqual(key string, prev *[skiplistMaxHeight]*skiplistNode) *skiplistNode {
+	x := t.head
+	for level := int(t.height.Load()) - 1; level >= 0; level-- {
+		next := x.next[level].Load()
+		for next != nil && next.key < key {
+			x = next
+			next = x.next[level].Load()
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+func (t *MemTable) findLessThan(key string) *skiplistNode {
+	x := t.head
+	for level := int(t.height.Load()) - 1; level >= 0; level-- {
+		next := x.next[level].Load()
+		for next != nil && next.key < key {
+			x = next
+			next = x.next[level].Load()
+		}
+	}
+	if x == t.head {
+		return nil
+	}
+	return x
+}
+
+func (t *MemTable) findLast() *skiplistNode {
+	x := t.head
+	for level := int(t.height.Load()) - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil; next = x.next[level].Load() {
+			x = next
+		}
+	}
+	if x == t.head {
+		return nil
+	}
+	return x
+}
+
+func (t *MemTable) apply(key string, v VersionedValue, op MergeOperator) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	versions, err := t.prepare(key, v, nil, op)
+	if err != nil {
+		return err
+	}
+	t.set(key, versions)
+	return nil
 }
 
 func (t *MemTable) Get(key string) (VersionedValue, bool) {
-	if value, ok := t.values[key]; ok {
-		return value, true
+	if versions := t.versions(key); len(versions) > 0 {
+		return versions[0], true
 	}
 	return VersionedValue{}, false
 }
 
-func (t *MemTable) Size() int {
-	return len(t.values)
+func (t *MemTable) versions(key string) []VersionedValue {
+	n := t.findGreaterOrEqual(key, nil)
+	if n == nil || n.key != key {
+		return nil
+	}
+	return n.loadVersions()
+}
+
+func (t *MemTable) Size() int64 {
+	return t.size.Load()
+}
+
+func (t *MemTable) Len() int {
+	return int(t.count.Load())
 }
 
 func (t *MemTable) SortedEntries() []MemTableEntry {
-	entries := make([]MemTableEntry, 0, len(t.values))
-	for k, v := range t.values {
-		entries = append(entries, MemTableEntry{Key: k, Value: v})
+	entries := make([]MemTableEntry, 0, t.Len())
+	it := t.newIterator(false)
+	for it.first(); it.valid(); it.next() {
+		v, _ := it.value()
+		entries = append(entries, MemTableEntry{Key: it.key(), Value: v})
 	}
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Key < entries[j].Key
-	})
 	return entries
 }
+
+type memIterator struct {
+	t        *MemTable
+	reverse  bool
+	node     *skiplistNode
+	versions []VersionedValue
+	i        int
+}
+
+func (t *MemTable) newIterator(reverse bool) *memIterator {
+	return &memIterator{t: t, reverse: reverse}
+}
+
+func (m *memIterator) first() {
+	if m.reverse {
+		m.load(m.t.findLast())
+		return
+	}
+	m.load(m.t.head.next[0].Load())
+}
+
+func (m *memIterator) seek(key string) {
+	n := m.t.findGreaterOrEqual(key, nil)
+	if m.reverse && (n == nil || n.key != key) {
+		n = m.t.findLessThan(key)
+	}
+	m.load(n)
+}
+
+func (m *memIterator) next() {
+	m.i++
+	if m.i < len(m.versions) {
+		return
+	}
+	if m.reverse {
+		m.load(m.t.findLessThan(m.node.key))
+		return
+	}
+	m.load(m.node.next[0].Load())
+}
+
+func (m *memIterator) load(n *skiplistNode) {
+	for n != nil {
+		m.node, m.versions, m.i = n, n.loadVersions(), 0
+		if len(m.versions) > 0 {
+			return
+		}
+		if m.reverse {
+			n = m.t.findLessThan(n.key)
+		} else {
+			n = n.next[0].Load()
+		}
+	}
+	m.node, m.versions, m.i = nil, nil, 0
+}
+
+func (m *memIterator) valid() bool { return m.node != nil }
+
+func (m *memIterator) key() string { return m.node.key }
+
+func (m *memIterator) value() (VersionedValue, error) { return m.versions[m.i], nil }
+
+func (m *memIterator) err() error { return nil }
@@ -0,0 +1,71 @@
+package lsm
+
+import (
+	"sort"
+	"time"
+)
+
+// MergeOperator combines merge operands written with LSM.Merge. Merge must be
+// associative: runs of operands are collapsed with a nil existing value before
+// their base value is known.
+type MergeOperator interface {
+	Name() string
+	Merge(key string, existing *string, operands []string) (string, error)
+}
+
+type LastWriteWins struct{}
+
+func (LastWriteWins) Name() string { return "last-write-wins" }
+
+func (LastWriteWins) Merge(key string, existing *string, operands []string) (string, error) {
+	if len(operands) == 0 {
+		if existing == nil {
+			return "", nil
+		}
+		return *existing, nil
+	}
+	return operands[len(operands)-1], nil
+}
+
+func resolveVersions(key string, vals []VersionedValue, op MergeOperator, bottom bool) (VersionedValue, error) {
+	if len(vals) == 0 {
+		return VersionedValue{}, nil
+	}
+	sort.SliceStable(vals, func(i, j int) bool {
+		return vals[i].sequenceNumber > vals[j].sequenceNumber
+	})
+	maxSeq := vals[0].sequenceNumber
+	now := time.Now().UnixNano()
+
+	var operands []string
+	var base *string
+	complete := bottom
+	for _, v := range vals {
+		if v.kind == kindMerge {
+			operands = append(operands, *v.value)
+			continue
+		}
+		if v.expired(now) {
+			v = VersionedValue{sequenceNumber: v.sequenceNumber, kind: kindDelete}
+		}
+		if len(operands) == 0 {
+			return v, nil
+		}
+		base = v.value
+		complete = true
+		break
+	}
+
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	merged, err := op.Merge(key, base, operands)
+	if err != nil {
+		return VersionedValue{}, err
+	}
+	kind := kindMerge
+	if complete {
+		kind = kindPut
+	}
+	return VersionedValue{value: &merged, sequenceNumber: maxSeq, kind: kind}, nil
+}
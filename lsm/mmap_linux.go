@@ -0,0 +1,21 @@
+//go:build linux
+
+package lsm
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func mmapFile(f File, size uint64) ([]byte, error) {
+	osf, ok := f.(*os.File)
+	if !ok {
+		return nil, nil
+	}
+	return unix.Mmap(int(osf.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error {
+	return unix.Munmap(b)
+}
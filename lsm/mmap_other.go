@@ -0,0 +1,11 @@
+//go:build !linux
+
+package lsm
+
+func mmapFile(f File, size uint64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package lsm
+
+import "time"
+
+type Options struct {
+	MaxSize             int
+	MaxFilesPerLevel    int
+	BaseLevelBytes      uint64
+	LevelSizeMultiplier uint64
+	TargetFileSize      uint64
+	MaxLevels           int
+	BlockSize           int
+	BlockCacheBytes     int64
+	MmapReads           bool
+	MaxOpenTables       int
+	Compression         Compression
+	Bloom               BloomPolicy
+	BloomPerLevel       []BloomPolicy
+	Sync                SyncPolicy
+	SyncInterval        time.Duration
+	MergeOperator       MergeOperator
+	CompactionFilter    CompactionFilter
+	ValueLogThreshold   int
+	ValueLogFileSize    int64
+	FS                  FS
+
+	CompactionWorkers          int
+	MaxSubcompactions          int
+	MaxImmutableMemTables      int
+	L0SlowdownWritesTrigger    int
+	L0StopWritesTrigger        int
+	SoftPendingCompactionBytes uint64
+	HardPendingCompactionBytes uint64
+	OnBackgroundError          func(error)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxSize:             4 << 20,
+		MaxFilesPerLevel:    6,
+		BaseLevelBytes:      8 << 20,
+		LevelSizeMultiplier: 10,
+		TargetFileSize:      2 << 20,
+		MaxLevels:           7,
+		BlockSize:           defaultBlockSize,
+		BlockCacheBytes:     8 << 20,
+		MaxOpenTables:       1000,
+		Compression:         CompressionSnappy,
+		Bloom:               BloomPolicy{BitsPerKey: defaultBloomBitsPerKey},
+		Sync:                SyncGrouped,
+		SyncInterval:        10 * time.Millisecond,
+		MergeOperator:       LastWriteWins{},
+		ValueLogFileSize:    64 << 20,
+
+		CompactionWorkers:          2,
+		MaxSubcompactions:          4,
+		MaxImmutableMemTables:      2,
+		L0SlowdownWritesTrigger:    20,
+		L0StopWritesTrigger:        36,
+		SoftPendingCompactionBytes: 64 << 30,
+		HardPendingCompactionBytes: 256 << 30,
+	}
+}
@@ -0,0 +1,88 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	logRecordHeaderSize = 8
+	maxLogRecordSize    = 1 << 28
+)
+
+func appendLogRecord(w io.Writer, payload []byte) error {
+	buf := make([]byte, logRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	copy(buf[logRecordHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readLogRecords(r io.Reader, fn func(payload []byte) error) error {
+	return scanLogRecords(r, false, fn)
+}
+
+func readLogRecordsStrict(r io.Reader, fn func(payload []byte) error) error {
+	return scanLogRecords(r, true, fn)
+}
+
+func scanLogRecords(r io.Reader, strict bool, fn func(payload []byte) error) error {
+	var hdr [logRecordHeaderSize]byte
+	var off uint64
+	damaged := func() error {
+		if !strict {
+			return nil
+		}
+		if off == 0 {
+			return &logRecordError{Offset: off}
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return &logRecordError{Offset: off}
+	}
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return damaged()
+			}
+			return err
+		}
+		sum := binary.LittleEndian.Uint32(hdr[0:4])
+		n := binary.LittleEndian.Uint32(hdr[4:8])
+		if n > maxLogRecordSize {
+			return damaged()
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return damaged()
+			}
+			return err
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return damaged()
+		}
+		if err := fn(payload); err != nil {
+			return err
+		}
+		off += logRecordHeaderSize + uint64(n)
+	}
+}
+
+type logRecordError struct {
+	Offset uint64
+}
+
+func (e *logRecordError) Error() string {
+	return fmt.Sprintf("log: damaged record at offset %d", e.Offset)
+}
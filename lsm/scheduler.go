@@ -0,0 +1,256 @@
+package lsm
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrClosed = errors.New("lsm: closed")
+
+const writeSlowdownDelay = time.Millisecond
+
+type immutableMemTable struct {
+	table    *MemTable
+	segments []uint64
+}
+
+func (l *LSM) startWorkers(n int) {
+	for i := 0; i < max(n, 1); i++ {
+		l.workers.Add(1)
+		go l.worker()
+	}
+}
+
+func (l *LSM) worker() {
+	defer l.workers.Done()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for {
+		if l.closed && l.idleLocked() {
+			return
+		}
+		if l.bgErr == nil && !l.flushing && len(l.immutables) > 0 {
+			l.flushLocked()
+			continue
+		}
+		if l.bgErr == nil {
+			c, err := l.pickCompactionLocked()
+			if err != nil {
+				l.setBackgroundErrorLocked(err)
+				continue
+			}
+			if c != nil {
+				l.runCompactionLocked(c)
+				continue
+			}
+		}
+		if l.closed && (l.bgErr != nil || l.idleLocked()) {
+			return
+		}
+		l.cond.Wait()
+	}
+}
+
+func (l *LSM) flushLocked() {
+	imm := l.immutables[0]
+	l.flushing = true
+	path := l.newFilePathLocked(0)
+	l.mutex.Unlock()
+
+	start := time.Now()
+	sst, err := createSSTable(path, imm.table, l.tableOptsForLevel(0))
+	if err == nil {
+		l.metrics.flushes.record(time.Since(start), sst.size)
+	}
+
+	l.mutex.Lock()
+	l.flushing = false
+	defer l.cond.Broadcast()
+	if err != nil {
+		l.setBackgroundErrorLocked(err)
+		return
+	}
+	l.ensureLevelLocked(0)
+	flushed := l.flushedWAL
+	for _, id := range imm.segments {
+		l.flushedWAL = max(l.flushedWAL, id)
+	}
+	if err := l.logEditLocked(versionEdit{added: []manifestTable{sst.manifestTable(0)}}); err != nil {
+		l.flushedWAL = flushed
+		sst.obsolete.Store(true)
+		sst.release()
+		l.setBackgroundErrorLocked(err)
+		return
+	}
+	l.files[0] = append(l.files[0], sst)
+	l.immutables = l.immutables[1:]
+
+	if l.wal != nil && len(imm.segments) > 0 {
+		l.mutex.Unlock()
+		err := l.fs.SyncDir(l.dir)
+		if err == nil {
+			err = l.wal.remove(imm.segments)
+		}
+		l.mutex.Lock()
+		if err != nil {
+			l.setBackgroundErrorLocked(err)
+		}
+	}
+}
+
+func (l *LSM) setBackgroundErrorLocked(err error) {
+	if l.bgErr != nil {
+		return
+	}
+	l.bgErr = err
+	l.cond.Broadcast()
+	if l.onBackgroundError != nil {
+		go l.onBackgroundError(err)
+	}
+}
+
+func (l *LSM) Err() error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.bgErr
+}
+
+func (l *LSM) idleLocked() bool {
+	return len(l.immutables) == 0 && !l.flushing && l.runningCompactions == 0 && l.pickCompactionLevelLocked() < 0
+}
+
+func (l *LSM) makeRoomLocked() error {
+	slowed := false
+	for {
+		switch {
+		case l.closed:
+			return ErrClosed
+		case l.bgErr != nil:
+			return l.bgErr
+		case l.memTable.Size() > int64(l.maxSize) && len(l.immutables) < l.maxImmutables:
+			if err := l.rotateMemTableLocked(); err != nil {
+				return err
+			}
+		case l.memTable.Size() > int64(l.maxSize), l.writeStopLocked():
+			l.cond.Wait()
+		case !slowed && l.writeSlowdownLocked():
+			slowed = true
+			l.mutex.Unlock()
+			time.Sleep(writeSlowdownDelay)
+			l.mutex.Lock()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *LSM) writeStopLocked() bool {
+	return len(l.levelFilesLocked(0)) >= l.l0StopWritesTrigger ||
+		(l.hardPendingCompactionBytes > 0 && l.pendingCompactionBytesLocked() >= l.hardPendingCompactionBytes)
+}
+
+func (l *LSM) writeSlowdownLocked() bool {
+	return len(l.levelFilesLocked(0)) >= l.l0SlowdownWritesTrigger ||
+		(l.softPendingCompactionBytes > 0 && l.pendingCompactionBytesLocked() >= l.softPendingCompactionBytes)
+}
+
+func (l *LSM) levelFilesLocked(level int) []*SSTable {
+	if level >= len(l.files) {
+		return nil
+	}
+	return l.files[level]
+}
+
+func (l *LSM) pendingCompactionBytesLocked() uint64 {
+	var pending uint64
+	if len(l.levelFilesLocked(0)) > l.maxFilesPerLevel {
+		pending += tablesBytes(l.files[0])
+	}
+	for level := 1; level < len(l.files) && level < l.maxLevels-1; level++ {
+		if size, target := tablesBytes(l.files[level]), l.levelTargetBytes(level); size > target {
+			pending += size - target
+		}
+	}
+	return pending
+}
+
+func (l *LSM) rotateMemTableLocked() error {
+	if l.memTable.Len() == 0 {
+		return nil
+	}
+	var segments []uint64
+	if l.wal != nil {
+		var err error
+		if segments, err = l.wal.rotate(); err != nil {
+			l.setBackgroundErrorLocked(err)
+			return err
+		}
+	}
+	l.immutables = append(l.immutables, &immutableMemTable{table: l.memTable, segments: segments})
+	l.memTable = NewMemTable()
+	l.cond.Broadcast()
+	return nil
+}
+
+func (l *LSM) Compact() error {
+	l.writeMutex.Lock()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		l.writeMutex.Unlock()
+		return ErrClosed
+	}
+	if l.bgErr == nil {
+		if err := l.rotateMemTableLocked(); err != nil {
+			l.writeMutex.Unlock()
+			return err
+		}
+	}
+	l.writeMutex.Unlock()
+	return l.waitIdleLocked()
+}
+
+func (l *LSM) waitIdleLocked() error {
+	for l.bgErr == nil && !l.idleLocked() {
+		l.cond.Wait()
+	}
+	return l.bgErr
+}
+
+func (l *LSM) Close() error {
+	l.writeMutex.Lock()
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		l.writeMutex.Unlock()
+		return ErrClosed
+	}
+	var errs []error
+	if l.bgErr == nil {
+		errs = append(errs, l.rotateMemTableLocked())
+	}
+	l.writeMutex.Unlock()
+	errs = append(errs, l.waitIdleLocked())
+	l.closed = true
+	l.cond.Broadcast()
+	l.mutex.Unlock()
+
+	l.workers.Wait()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.wal != nil {
+		errs = append(errs, l.wal.close())
+	}
+	if l.manifest != nil {
+		errs = append(errs, l.manifest.close())
+	}
+	for _, level := range l.files {
+		for _, t := range level {
+			t.release()
+		}
+	}
+	l.files = nil
+	errs = append(errs, l.values.close())
+	return errors.Join(errs...)
+}
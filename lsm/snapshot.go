@@ -0,0 +1,96 @@
+package lsm
+
+import "sort"
+
+const latestSequence = ^uint32(0)
+
+type Reader interface {
+	Get(key string) *string
+	GetErr(key string) (*string, error)
+	Range(start, end string, reverse bool) *Iterator
+	Prefix(prefix string, reverse bool) *Iterator
+}
+
+type Snapshot struct {
+	l        *LSM
+	seq      uint32
+	released bool
+}
+
+func (l *LSM) Snapshot() *Snapshot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s := &Snapshot{l: l, seq: l.sequenceNumber}
+	l.snapshots = append(l.snapshots, s.seq)
+	return s
+}
+
+func (s *Snapshot) Get(key string) *string {
+	v, _ := s.GetErr(key)
+	return v
+}
+
+func (s *Snapshot) GetErr(key string) (*string, error) {
+	v, _, err := s.l.lookup(key, s.seq)
+	return v.value, err
+}
+
+func (s *Snapshot) Range(start, end string, reverse bool) *Iterator {
+	it := s.l.newIterator(start, end, reverse, s.seq)
+	it.rewind()
+	return it
+}
+
+func (s *Snapshot) Prefix(prefix string, reverse bool) *Iterator {
+	return s.Range(prefix, prefixSuccessor(prefix), reverse)
+}
+
+func (s *Snapshot) Release() {
+	l := s.l
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	for i, seq := range l.snapshots {
+		if seq == s.seq {
+			l.snapshots = append(l.snapshots[:i], l.snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *LSM) snapshotsLocked() []uint32 {
+	if len(l.snapshots) == 0 {
+		return nil
+	}
+	return append([]uint32(nil), l.snapshots...)
+}
+
+func collapseVersions(key string, vals []VersionedValue, snapshots []uint32, op MergeOperator, bottom bool) ([]VersionedValue, error) {
+	sort.SliceStable(vals, func(i, j int) bool {
+		return vals[i].sequenceNumber > vals[j].sequenceNumber
+	})
+	stripe := func(v VersionedValue) int {
+		return sort.Search(len(snapshots), func(i int) bool { return snapshots[i] > v.sequenceNumber })
+	}
+
+	out := make([]VersionedValue, 0, 1)
+	for start := 0; start < len(vals); {
+		end := start + 1
+		for end < len(vals) && stripe(vals[end]) == stripe(vals[start]) {
+			end++
+		}
+		oldest := end == len(vals)
+		v, err := resolveVersions(key, vals[start:end], op, bottom && oldest)
+		if err != nil {
+			return nil, err
+		}
+		if !(oldest && bottom && v.kind == kindDelete) {
+			out = append(out, v)
+		}
+		start = end
+	}
+	return out, nil
+}
@@ -1,428 +1,635 @@
 package lsm
 
 import (
-	"bufio"
+	"bytes"
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/emirpasic/gods/trees/binaryheap"
 )
 
+const (
+	sstFormatV1          = 1
+	sstFormatBlocks      = 2
+	sstFormatCompressed  = 3
+	sstFormatChecksummed = 4
+	sstFormatPrefixed    = 5
+	sstFormatValueLog    = 6
+
+	sstMagic              uint64 = 0x3242545353534c4d
+	blockFooterSize              = 36
+	checksummedFooterSize        = 40
+	defaultBlockSize             = 4 << 10
+)
+
+var nextTableCacheID atomic.Uint64
+
 type SSTable struct {
-	path            string
-	f               *os.File
-	keyCount        int
+	path     string
+	refs     atomic.Int32
+	obsolete atomic.Bool
+	version  int
+	keyCount int
+	size     uint64
+	minKey   string
+	maxKey   string
+	bloom    *BloomFilter
+
 	indexStart      uint64
 	offsetsStart    uint64
 	keyOffsetsStart uint64
-	minKey          string
-	maxKey          string
-	bloom           *BloomFilter
+
+	blocks  []blockHandle
+	cache   *BlockCache
+	cacheID uint64
+
+	bloomCounters *bloomCounters
+
+	globalSeq    uint32
+	hasGlobalSeq bool
+
+	valueLog   *valueLog
+	valueFiles []uint64
+
+	fs             FS
+	fileMutex      sync.Mutex
+	f              File
+	mmap           bool
+	data           []byte
+	fileUsers      int
+	closed         bool
+	tableCache     *TableCache
+	tableCacheElem *list.Element
+
+	compacting bool
 }
 
-func CreateSSTableFromMemTable(path string, table *MemTable) (*SSTable, error) {
-	entries := table.SortedEntries()
+type tableOptions struct {
+	blockSize       int
+	compression     Compression
+	cache           *BlockCache
+	bloomBitsPerKey float64
+	bloomCounters   *bloomCounters
+	mmap            bool
+	tableCache      *TableCache
+	valueLog        *valueLog
+	fs              FS
+}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return nil, err
-	}
+func defaultTableOptions() tableOptions {
+	return tableOptions{blockSize: defaultBlockSize, bloomBitsPerKey: defaultBloomBitsPerKey, fs: OSFS{}}
+}
+
+func CreateSSTableFromMemTable(path string, table *MemTable) (*SSTable, error) {
+	return createSSTable(path, table, defaultTableOptions())
+}
 
-	f, err := os.Create(path)
+func createSSTable(path string, table *MemTable, opts tableOptions) (*SSTable, error) {
+	w, err := newSSTWriter(path, opts)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			_ = f.Close()
-			_ = os.Remove(path)
+	it := table.newIterator(false)
+	for it.first(); it.valid(); it.next() {
+		v, _ := it.value()
+		if err := w.add(it.key(), v); err != nil {
+			w.abort()
+			return nil, err
 		}
-	}()
+	}
+	return w.finish()
+}
 
-	keys := make([]string, 0, len(entries))
-	offsets := make([]uint64, 0, len(entries))
+func MergeSSTables(path string, op MergeOperator, tables ...*SSTable) (*SSTable, error) {
+	return mergeSSTables(path, defaultTableOptions(), mergePolicy{op: op}, tables...)
+}
 
-	bloom := NewBloomFilter(len(entries))
-	for _, e := range entries {
-		keys = append(keys, e.Key)
-		offsets = append(offsets, 0)
-		bloom.AddString(e.Key)
+func mergeSSTables(path string, opts tableOptions, p mergePolicy, tables ...*SSTable) (*SSTable, error) {
+	w, err := newSSTWriter(path, opts)
+	if err != nil {
+		return nil, err
 	}
-
-	bw := bufio.NewWriter(f)
-	cw := &countingWriter{w: bw}
-	if _, err = cw.Write(headerBytes(uint32(len(entries)), bloom)); err != nil {
+	err = mergeKWay(tables, p, w.add)
+	if err != nil {
+		w.abort()
 		return nil, err
 	}
+	return w.finish()
+}
 
-	for i, e := range entries {
-		offsets[i] = cw.n
-		if _, err = writeRecord(cw, e.Value); err != nil {
-			return nil, err
+func compactRange(newPath func() string, opts tableOptions, p mergePolicy, targetFileSize uint64, r mergeBounds, tables ...*SSTable) ([]*SSTable, error) {
+	var out []*SSTable
+	var w *sstWriter
+	cleanup := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range out {
+			_ = t.Close()
+			_ = t.fs.Remove(t.Path())
 		}
 	}
 
-	indexStart := cw.n
-	indexLen, err := writeIndex(cw, keys, offsets)
+	err := mergeRange(tables, r, p, func(key string, v VersionedValue) error {
+		if w != nil && w.size() >= targetFileSize && key != w.lastKey {
+			t, err := w.finish()
+			w = nil
+			if err != nil {
+				return err
+			}
+			out = append(out, t)
+		}
+		if w == nil {
+			var err error
+			if w, err = newSSTWriter(newPath(), opts); err != nil {
+				return err
+			}
+		}
+		return w.add(key, v)
+	})
 	if err != nil {
+		cleanup()
 		return nil, err
 	}
-	if err = writeFooter(cw, indexStart, uint32(indexLen)); err != nil {
-		return nil, err
-	}
-	if err = bw.Flush(); err != nil {
-		return nil, err
+	if w != nil {
+		t, err := w.finish()
+		w = nil
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		out = append(out, t)
 	}
+	return out, nil
+}
+
+func OpenSSTable(path string) (*SSTable, error) {
+	return openSSTable(path, defaultTableOptions())
+}
 
-	if _, err = f.Seek(0, io.SeekStart); err != nil {
+func openSSTable(path string, opts tableOptions) (*SSTable, error) {
+	f, err := fileSystem(opts.fs).Open(path)
+	if err != nil {
 		return nil, err
 	}
-
-	s := &SSTable{path: path, f: f}
+	s := newSSTable(path, f, opts)
 	if err := s.load(); err != nil {
+		_ = s.Close()
 		return nil, err
 	}
+	s.fileOpened()
+	s.valueLog.retain(s.valueFiles)
 	return s, nil
 }
 
-func MergeSSTables(path string, tables ...*SSTable) (*SSTable, error) {
-	expected := 0
-	for _, t := range tables {
-		expected += t.keyCount
-	}
-	bloom := NewBloomFilter(expected)
-	headerSize := 16 + 8*len(bloom.bits)
+func newSSTable(path string, f File, opts tableOptions) *SSTable {
+	s := &SSTable{
+		path:          path,
+		fs:            fileSystem(opts.fs),
+		f:             f,
+		mmap:          opts.mmap,
+		cache:         opts.cache,
+		cacheID:       nextTableCacheID.Add(1),
+		bloomCounters: opts.bloomCounters,
+		tableCache:    opts.tableCache,
+		valueLog:      opts.valueLog,
+	}
+	s.refs.Store(1)
+	return s
+}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return nil, err
-	}
+func (s *SSTable) acquire() {
+	s.refs.Add(1)
+}
 
-	f, err := os.Create(path)
-	if err != nil {
-		return nil, err
+func (s *SSTable) release() {
+	if s.refs.Add(-1) != 0 {
+		return
 	}
-	defer func() {
-		if err != nil {
-			_ = f.Close()
-			_ = os.Remove(path)
+	_ = s.Close()
+	if s.obsolete.Load() {
+		if s.cache != nil {
+			s.cache.evictTable(s.cacheID)
 		}
-	}()
-
-	bw := bufio.NewWriter(f)
-	cw := &countingWriter{w: bw}
-	if _, err = cw.Write(make([]byte, headerSize)); err != nil {
-		return nil, err
+		_ = s.fs.Remove(s.path)
+		s.valueLog.release(s.valueFiles)
 	}
+}
 
-	dir := filepath.Dir(path)
-	mk := func() (*os.File, *bufio.Writer, error) {
-		tf, err := os.CreateTemp(dir, "sst-*.tmp")
-		if err != nil {
-			return nil, nil, err
-		}
-		return tf, bufio.NewWriter(tf), nil
+func (s *SSTable) Path() string { return s.path }
+
+func (s *SSTable) setGlobalSeq(seq uint32) {
+	s.globalSeq = seq
+	s.hasGlobalSeq = true
+}
+
+func (s *SSTable) manifestTable(level int) manifestTable {
+	return manifestTable{level: level, name: filepath.Base(s.path), globalSeq: s.globalSeq, ingested: s.hasGlobalSeq}
+}
+
+func (s *SSTable) Close() error {
+	s.fileMutex.Lock()
+	s.closed = true
+	var err error
+	if s.fileUsers == 0 {
+		err = s.closeFileLocked()
 	}
-	keysF, keysW, err := mk()
-	if err != nil {
-		return nil, err
+	s.fileMutex.Unlock()
+	if s.tableCache != nil {
+		s.tableCache.remove(s)
 	}
-	offsF, offsW, err := mk()
-	if err != nil {
-		return nil, err
+	return err
+}
+
+func (s *SSTable) closeFileLocked() error {
+	if s.f == nil {
+		return nil
 	}
-	keyOffsF, keyOffsW, err := mk()
-	if err != nil {
-		return nil, err
+	if s.data != nil {
+		_ = munmapFile(s.data)
+		s.data = nil
 	}
-	defer func() {
-		for _, tf := range []*os.File{keysF, offsF, keyOffsF} {
-			if tf != nil {
-				_ = tf.Close()
-				_ = os.Remove(tf.Name())
-			}
-		}
-	}()
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
 
-	var keyEntriesN uint64
-	var u32 [4]byte
-	var u64 [8]byte
+func (s *SSTable) closeIdleFile() bool {
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+	if s.fileUsers > 0 {
+		return false
+	}
+	_ = s.closeFileLocked()
+	return true
+}
 
-	outCount := 0
-	err = mergeKWay(tables, func(key string, best VersionedValue) error {
-		bloom.AddString(key)
-		outCount++
+func (s *SSTable) fileOpened() {
+	if s.tableCache != nil {
+		s.tableCache.touch(s)
+	}
+}
 
-		recordOffset := cw.n
-		if _, err := writeRecord(cw, best); err != nil {
+func (s *SSTable) withFile(fn func() error) error {
+	s.fileMutex.Lock()
+	if s.f == nil {
+		if err := s.openFileLocked(); err != nil {
+			s.fileMutex.Unlock()
 			return err
 		}
+	}
+	s.fileUsers++
+	s.fileMutex.Unlock()
+	s.fileOpened()
 
-		start := uint32(keyEntriesN)
-		kb := []byte(key)
-		binary.LittleEndian.PutUint32(u32[:], uint32(len(kb)))
-		if _, err := keysW.Write(u32[:]); err != nil {
-			return err
-		}
-		if _, err := keysW.Write(kb); err != nil {
-			return err
+	defer func() {
+		s.fileMutex.Lock()
+		s.fileUsers--
+		if s.closed && s.fileUsers == 0 {
+			_ = s.closeFileLocked()
 		}
-		keyEntriesN += uint64(4 + len(kb))
+		s.fileMutex.Unlock()
+	}()
+	return fn()
+}
 
-		binary.LittleEndian.PutUint64(u64[:], recordOffset)
-		if _, err := offsW.Write(u64[:]); err != nil {
+func (s *SSTable) openFileLocked() error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	f, err := s.fs.Open(s.path)
+	if err != nil {
+		return err
+	}
+	if s.mmap && s.size > 0 {
+		if s.data, err = mmapFile(f, s.size); err != nil {
+			_ = f.Close()
 			return err
 		}
+	}
+	s.f = f
+	return nil
+}
 
-		binary.LittleEndian.PutUint32(u32[:], start)
-		_, err := keyOffsW.Write(u32[:])
-		return err
-	})
-	if err != nil {
+func (s *SSTable) readAt(n int, off uint64) ([]byte, error) {
+	if s.data != nil {
+		if off > uint64(len(s.data)) || uint64(n) > uint64(len(s.data))-off {
+			return nil, io.EOF
+		}
+		return s.data[off : off+uint64(n)], nil
+	}
+	b := make([]byte, n)
+	if _, err := s.f.ReadAt(b, int64(off)); err != nil {
 		return nil, err
 	}
+	return b, nil
+}
 
-	if err = keysW.Flush(); err != nil {
-		return nil, err
+func (s *SSTable) Get(key string) (VersionedValue, bool, error) {
+	versions, err := s.getVersions(key)
+	if err != nil || len(versions) == 0 {
+		return VersionedValue{}, false, err
 	}
-	if err = offsW.Flush(); err != nil {
-		return nil, err
+	return versions[0], true, nil
+}
+
+func (s *SSTable) getVersions(key string) ([]VersionedValue, error) {
+	if s.bloom == nil {
+		return s.lookupVersions(key)
 	}
-	if err = keyOffsW.Flush(); err != nil {
-		return nil, err
+	if !s.bloom.MightContainString(key) {
+		s.bloomCounters.record(false, false)
+		return nil, nil
 	}
-	if err = bw.Flush(); err != nil {
-		return nil, err
+	versions, err := s.lookupVersions(key)
+	if err == nil {
+		s.bloomCounters.record(true, len(versions) > 0)
 	}
+	return versions, err
+}
 
-	indexStart := cw.n
-	indexLen := keyEntriesN + uint64(outCount)*8 + uint64(outCount)*4
-
-	for _, tf := range []*os.File{keysF, offsF, keyOffsF} {
-		if _, err := tf.Seek(0, io.SeekStart); err != nil {
-			return nil, err
-		}
-		if _, err := io.Copy(f, tf); err != nil {
-			return nil, err
+func (s *SSTable) lookupVersions(key string) ([]VersionedValue, error) {
+	if s.version == sstFormatV1 {
+		v, ok, err := s.getV1(key)
+		if err != nil || !ok {
+			return nil, s.corruption(0, err)
 		}
+		return []VersionedValue{v}, nil
 	}
 
-	if err = writeFooter(f, indexStart, uint32(indexLen)); err != nil {
-		return nil, err
+	i := s.blockFor(key)
+	if i < 0 {
+		return nil, nil
 	}
-	if _, err = f.WriteAt(headerBytes(uint32(outCount), bloom), 0); err != nil {
+	var versions []VersionedValue
+	err := s.readBlock(i, func(data []byte) (err error) {
+		versions, err = searchBlock(data, key, s.version >= sstFormatPrefixed)
+		return s.corruption(s.blocks[i].offset, err)
+	})
+	if err != nil {
 		return nil, err
 	}
-	if _, err = f.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+	if s.hasGlobalSeq {
+		for i := range versions {
+			versions[i].sequenceNumber = s.globalSeq
+		}
 	}
+	return versions, nil
+}
 
-	s := &SSTable{path: path, f: f}
-	if err := s.load(); err != nil {
-		return nil, err
+func (s *SSTable) newIterator(reverse bool) internalIterator {
+	if s.version == sstFormatV1 {
+		return &v1Iterator{t: s, reverse: reverse}
 	}
-	return s, nil
+	return &blockIterator{t: s, reverse: reverse}
 }
 
-func (s *SSTable) Path() string { return s.path }
-
-func (s *SSTable) Close() error {
-	if s.f == nil {
-		return nil
+func (s *SSTable) load() error {
+	size, err := fileSize(s.f)
+	if err != nil {
+		return err
 	}
-	return s.f.Close()
+	if s.mmap && size > 0 && s.data == nil {
+		if s.data, err = mmapFile(s.f, size); err != nil {
+			return err
+		}
+	}
+	if size >= blockFooterSize {
+		tail, err := s.readAt(12, size-12)
+		if err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint64(tail[4:12]) == sstMagic {
+			return s.corruption(0, s.loadBlocks(size, binary.LittleEndian.Uint32(tail[0:4])))
+		}
+	}
+	return s.corruption(0, s.loadV1(size))
 }
 
-func (s *SSTable) Get(key string) (VersionedValue, bool, error) {
-	if s.bloom != nil && !s.bloom.MightContainString(key) {
-		return VersionedValue{}, false, nil
+func (s *SSTable) loadBlocks(size uint64, version uint32) error {
+	footerSize := uint64(blockFooterSize)
+	switch version {
+	case sstFormatBlocks, sstFormatCompressed:
+	case sstFormatChecksummed, sstFormatPrefixed, sstFormatValueLog:
+		footerSize = checksummedFooterSize
+	default:
+		return errors.New("sstable: unsupported format version")
 	}
-	idx, ok, err := s.findKeyIndex(key)
-	if err != nil || !ok {
-		return VersionedValue{}, false, err
+	if size < footerSize {
+		return errBadFooter
 	}
-	offset, err := s.offsetAt(idx)
+	footer, err := s.readAt(int(footerSize), size-footerSize)
 	if err != nil {
-		return VersionedValue{}, false, err
+		return err
 	}
-	v, err := s.readRecordAt(offset)
-	if err != nil {
-		return VersionedValue{}, false, err
+	if version >= sstFormatChecksummed {
+		if _, err := verifyChecksum(footer[:28]); err != nil {
+			return err
+		}
+	}
+	indexStart := binary.LittleEndian.Uint64(footer[0:8])
+	indexLen := binary.LittleEndian.Uint32(footer[8:12])
+	headerStart := binary.LittleEndian.Uint64(footer[12:20])
+	headerLen := binary.LittleEndian.Uint32(footer[20:24])
+	if indexStart+uint64(indexLen) > size-footerSize || headerStart+uint64(headerLen) > indexStart {
+		return errBadFooter
 	}
-	return v, true, nil
-}
 
-func (s *SSTable) load() error {
-	size, err := fileSize(s.f)
+	header, err := s.readAt(int(headerLen), headerStart)
+	if err != nil {
+		return err
+	}
+	index, err := s.readAt(int(indexLen), indexStart)
 	if err != nil {
 		return err
 	}
-	if size < footerSizeBytes {
-		return errors.New("sstable: file too small")
+	if version >= sstFormatChecksummed {
+		if header, err = verifyChecksum(header); err != nil {
+			return err
+		}
+		if index, err = verifyChecksum(index); err != nil {
+			return err
+		}
 	}
-
-	footer := make([]byte, footerSizeBytes)
-	if _, err := s.f.ReadAt(footer, int64(size-footerSizeBytes)); err != nil {
+	keyCount, bloom, valueFiles, err := decodeHeader(header, version >= sstFormatValueLog)
+	if err != nil {
 		return err
 	}
-	indexStart := binary.LittleEndian.Uint64(footer[0:8])
-	indexLen := binary.LittleEndian.Uint32(footer[8:12])
-
-	keyCount, bloom, err := readHeaderAt(s.f, 0)
+	blocks, lastKey, err := decodeIndexBlock(index, version >= sstFormatPrefixed)
 	if err != nil {
 		return err
 	}
-
-	metaSize := uint64(keyCount)*8 + uint64(keyCount)*4
-	if uint64(indexLen) < metaSize {
-		return errors.New("sstable: index too small")
+	for i, h := range blocks {
+		if h.offset+uint64(h.length) > headerStart || (i > 0 && h.firstKey <= blocks[i-1].firstKey) {
+			return errBadBlock
+		}
 	}
-	keyEntriesLen := uint64(indexLen) - metaSize
-	offsetsStart := indexStart + keyEntriesLen
-	keyOffsetsStart := offsetsStart + uint64(keyCount)*8
 
+	s.version = int(version)
 	s.keyCount = int(keyCount)
-	s.indexStart = indexStart
-	s.offsetsStart = offsetsStart
-	s.keyOffsetsStart = keyOffsetsStart
+	s.size = size
 	s.bloom = bloom
-
-	if s.keyCount > 0 {
-		minK, err := s.keyAt(0)
-		if err != nil {
-			return err
-		}
-		maxK, err := s.keyAt(s.keyCount - 1)
-		if err != nil {
-			return err
-		}
-		s.minKey = minK
-		s.maxKey = maxK
+	s.valueFiles = valueFiles
+	s.blocks = blocks
+	if len(blocks) > 0 {
+		s.minKey = blocks[0].firstKey
+		s.maxKey = lastKey
 	}
 	return nil
 }
 
-func (s *SSTable) findKeyIndex(key string) (int, bool, error) {
-	l, r := 0, s.keyCount
-	for l < r {
-		mid := (l + r) / 2
-		mk, err := s.keyAt(mid)
-		if err != nil {
-			return 0, false, err
-		}
-		if mk < key {
-			l = mid + 1
-		} else {
-			r = mid
+func (s *SSTable) blockFor(key string) int {
+	return sort.Search(len(s.blocks), func(i int) bool {
+		return s.blocks[i].firstKey > key
+	}) - 1
+}
+
+func (s *SSTable) readBlock(i int, fn func(data []byte) error) error {
+	h := s.blocks[i]
+	if s.cache != nil {
+		if data, ok := s.cache.get(s.cacheID, h.offset); ok {
+			return fn(data)
 		}
 	}
-	if l >= s.keyCount {
-		return 0, false, nil
+	var data []byte
+	var mapped bool
+	err := s.withFile(func() (err error) {
+		if data, mapped, err = s.blockContents(h); err != nil {
+			return s.corruption(h.offset, err)
+		}
+		if mapped {
+			return fn(data)
+		}
+		return nil
+	})
+	if err != nil || mapped {
+		return err
 	}
-	k, err := s.keyAt(l)
-	if err != nil {
-		return 0, false, err
+	if s.cache != nil {
+		s.cache.add(s.cacheID, h.offset, data)
 	}
-	return l, k == key, nil
+	return fn(data)
+}
+
+func (s *SSTable) readBlockFromFile(h blockHandle) (data []byte, err error) {
+	err = s.withFile(func() error {
+		var mapped bool
+		if data, mapped, err = s.blockContents(h); mapped {
+			data = bytes.Clone(data)
+		}
+		return err
+	})
+	return data, err
 }
 
-func (s *SSTable) keyAt(i int) (string, error) {
-	rel, err := s.keyOffsetAt(i)
+func (s *SSTable) blockContents(h blockHandle) (data []byte, mapped bool, err error) {
+	raw, err := s.readAt(int(h.length), h.offset)
 	if err != nil {
-		return "", err
+		return nil, false, err
 	}
-	off := int64(s.indexStart) + int64(rel)
-
-	var u32 [4]byte
-	if _, err := s.f.ReadAt(u32[:], off); err != nil {
-		return "", err
+	if s.version >= sstFormatChecksummed {
+		if raw, err = verifyChecksum(raw); err != nil {
+			return nil, false, err
+		}
+	}
+	if s.version < sstFormatCompressed {
+		return raw, s.data != nil, nil
 	}
-	keyLen := int(binary.LittleEndian.Uint32(u32[:]))
-	keyBytes := make([]byte, keyLen)
-	if _, err := s.f.ReadAt(keyBytes, off+4); err != nil {
-		return "", err
+	if data, err = decompressBlock(raw); err != nil {
+		return nil, false, err
 	}
-	return string(keyBytes), nil
+	return data, s.data != nil && Compression(raw[len(raw)-1]) == CompressionNone, nil
 }
 
-func (s *SSTable) keyOffsetAt(i int) (uint32, error) {
-	var u32 [4]byte
-	if _, err := s.f.ReadAt(u32[:], int64(s.keyOffsetsStart)+int64(i*4)); err != nil {
-		return 0, err
+func decodeHeader(b []byte, withValueFiles bool) (keyCount uint32, bloom *BloomFilter, valueFiles []uint64, err error) {
+	if len(b) < 16 {
+		return 0, nil, nil, errBadBlock
+	}
+	keyCount = binary.LittleEndian.Uint32(b[0:4])
+	mBits := binary.LittleEndian.Uint32(b[4:8])
+	wordCount := binary.LittleEndian.Uint32(b[8:12])
+	hashes := binary.LittleEndian.Uint32(b[12:16])
+	bloomEnd := 16 + uint64(wordCount)*8
+	if uint64(len(b)) < bloomEnd || (!withValueFiles && uint64(len(b)) != bloomEnd) || mBits == 0 || uint64(mBits) > uint64(wordCount)*64 || hashes > maxBloomHashes {
+		return 0, nil, nil, errBadBlock
 	}
-	return binary.LittleEndian.Uint32(u32[:]), nil
-}
 
-func (s *SSTable) offsetAt(i int) (uint64, error) {
-	var u64 [8]byte
-	if _, err := s.f.ReadAt(u64[:], int64(s.offsetsStart)+int64(i*8)); err != nil {
-		return 0, err
+	words := make([]uint64, wordCount)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(b[16+i*8:])
 	}
-	return binary.LittleEndian.Uint64(u64[:]), nil
+	if withValueFiles {
+		if valueFiles, err = decodeValueFiles(b[bloomEnd:]); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	return keyCount, &BloomFilter{mBits: uint64(mBits), hashes: hashes, bits: words}, valueFiles, nil
 }
 
-func (s *SSTable) readRecordAt(offset uint64) (VersionedValue, error) {
-	off := int64(offset)
-
-	var hv [1]byte
-	if _, err := s.f.ReadAt(hv[:], off); err != nil {
-		return VersionedValue{}, err
+func appendValueFiles(b []byte, ids []uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(len(ids)))
+	for _, id := range ids {
+		b = binary.AppendUvarint(b, id)
 	}
-	pos := off + 1
-
-	var valuePtr *string
-	if hv[0] == 1 {
-		var u32 [4]byte
-		if _, err := s.f.ReadAt(u32[:], pos); err != nil {
-			return VersionedValue{}, err
-		}
-		pos += 4
+	return b
+}
 
-		valLen := int(binary.LittleEndian.Uint32(u32[:]))
-		valBytes := make([]byte, valLen)
-		if _, err := s.f.ReadAt(valBytes, pos); err != nil {
-			return VersionedValue{}, err
+func decodeValueFiles(b []byte) ([]uint64, error) {
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)) {
+		return nil, errBadBlock
+	}
+	b = b[n:]
+	var ids []uint64
+	for i := uint64(0); i < count; i++ {
+		id, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errBadBlock
 		}
-		pos += int64(valLen)
-
-		valStr := string(valBytes)
-		valuePtr = &valStr
+		b = b[n:]
+		ids = append(ids, id)
 	}
-
-	var seq [4]byte
-	if _, err := s.f.ReadAt(seq[:], pos); err != nil {
-		return VersionedValue{}, err
+	if len(b) != 0 {
+		return nil, errBadBlock
 	}
-	return VersionedValue{value: valuePtr, sequenceNumber: binary.LittleEndian.Uint32(seq[:])}, nil
+	return ids, nil
 }
 
-const (
-	footerSizeBytes = 12
-)
-
-func readHeaderAt(f *os.File, off int64) (keyCount uint32, bloom *BloomFilter, err error) {
-	var hdr [16]byte
-	if _, err = f.ReadAt(hdr[:], off); err != nil {
+func (s *SSTable) readHeaderAt(off uint64) (keyCount uint32, bloom *BloomFilter, err error) {
+	hdr, err := s.readAt(16, off)
+	if err != nil {
 		return 0, nil, err
 	}
 
 	keyCount = binary.LittleEndian.Uint32(hdr[0:4])
 	mBits := binary.LittleEndian.Uint32(hdr[4:8])
 	wordCount := binary.LittleEndian.Uint32(hdr[8:12])
+	hashes := binary.LittleEndian.Uint32(hdr[12:16])
+	if mBits == 0 || uint64(mBits) > uint64(wordCount)*64 || hashes > maxBloomHashes || uint64(wordCount)*8 > s.size {
+		return 0, nil, errBadFooter
+	}
 
+	b, err := s.readAt(int(wordCount)*8, off+16)
+	if err != nil {
+		return 0, nil, err
+	}
 	words := make([]uint64, wordCount)
-	var u64 [8]byte
 	for i := range words {
-		if _, err := f.ReadAt(u64[:], off+16+int64(i)*8); err != nil {
-			return 0, nil, err
-		}
-		words[i] = binary.LittleEndian.Uint64(u64[:])
+		words[i] = binary.LittleEndian.Uint64(b[i*8:])
 	}
 
 	bloom = &BloomFilter{
-		mBits: uint64(mBits),
-		bits:  words,
+		mBits:  uint64(mBits),
+		hashes: hashes,
+		bits:   words,
 	}
 	return keyCount, bloom, nil
 }
@@ -432,7 +639,7 @@ func headerBytes(keyCount uint32, bloom *BloomFilter) []byte {
 	binary.LittleEndian.PutUint32(b[0:4], keyCount)
 	binary.LittleEndian.PutUint32(b[4:8], uint32(bloom.mBits))
 	binary.LittleEndian.PutUint32(b[8:12], uint32(len(bloom.bits)))
-	binary.LittleEndian.PutUint32(b[12:16], 0)
+	binary.LittleEndian.PutUint32(b[12:16], bloom.hashes)
 
 	pos := 16
 	for _, word := range bloom.bits {
@@ -442,89 +649,11 @@ func headerBytes(keyCount uint32, bloom *BloomFilter) []byte {
 	return b
 }
 
-func writeFooter(w io.Writer, indexStart uint64, indexLen uint32) error {
-	var ftr [footerSizeBytes]byte
-	binary.LittleEndian.PutUint64(ftr[0:8], indexStart)
-	binary.LittleEndian.PutUint32(ftr[8:12], indexLen)
-	_, err := w.Write(ftr[:])
-	return err
-}
-
 func writeRecord(w io.Writer, v VersionedValue) (int, error) {
-	var u32 [4]byte
-	var hv [1]byte
-	if v.value != nil {
-		hv[0] = 1
-	}
-	n := 0
-	if _, err := w.Write(hv[:]); err != nil {
-		return n, err
-	}
-	n++
-
-	if v.value != nil {
-		valueBytes := []byte(*v.value)
-		binary.LittleEndian.PutUint32(u32[:], uint32(len(valueBytes)))
-		if _, err := w.Write(u32[:]); err != nil {
-			return n, err
-		}
-		n += 4
-		if _, err := w.Write(valueBytes); err != nil {
-			return n, err
-		}
-		n += len(valueBytes)
-	}
-
-	var seq [4]byte
-	binary.LittleEndian.PutUint32(seq[:], v.sequenceNumber)
-	if _, err := w.Write(seq[:]); err != nil {
-		return n, err
-	}
-	n += 4
-	return n, nil
-}
-
-func writeIndex(w io.Writer, keys []string, offsets []uint64) (int, error) {
-	keyOffsets := make([]uint32, len(keys))
-
-	n := 0
-	var u32 [4]byte
-	for i, k := range keys {
-		keyOffsets[i] = uint32(n)
-
-		kb := []byte(k)
-		binary.LittleEndian.PutUint32(u32[:], uint32(len(kb)))
-		if _, err := w.Write(u32[:]); err != nil {
-			return 0, err
-		}
-		n += 4
-		if _, err := w.Write(kb); err != nil {
-			return 0, err
-		}
-		n += len(kb)
-	}
-
-	var u64 [8]byte
-	for _, off := range offsets {
-		binary.LittleEndian.PutUint64(u64[:], off)
-		if _, err := w.Write(u64[:]); err != nil {
-			return 0, err
-		}
-		n += 8
-	}
-
-	for _, ko := range keyOffsets {
-		binary.LittleEndian.PutUint32(u32[:], ko)
-		if _, err := w.Write(u32[:]); err != nil {
-			return 0, err
-		}
-		n += 4
-	}
-
-	return n, nil
+	return w.Write(appendRecord(nil, v))
 }
 
-func fileSize(f *os.File) (uint64, error) {
+func fileSize(f File) (uint64, error) {
 	st, err := f.Stat()
 	if err != nil {
 		return 0, err
@@ -543,91 +672,79 @@ func (c *countingWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-type it struct {
-	t   *SSTable
-	i   int
-	key string
+func mergeKWay(tables []*SSTable, p mergePolicy, emit func(key string, v VersionedValue) error) error {
+	return mergeRange(tables, mergeBounds{}, p, emit)
 }
 
-func mergeKWay(tables []*SSTable, emit func(key string, best VersionedValue) error) error {
+func mergeRange(tables []*SSTable, r mergeBounds, p mergePolicy, emit func(key string, v VersionedValue) error) error {
 	heap := binaryheap.NewWith(func(a, b any) int {
-		ai := a.(*it)
-		bi := b.(*it)
-		switch {
-		case ai.key < bi.key:
-			return -1
-		case ai.key > bi.key:
-			return 1
-		default:
-			return 0
-		}
+		return strings.Compare(a.(internalIterator).key(), b.(internalIterator).key())
 	})
 
 	for _, t := range tables {
-		if t.keyCount == 0 {
+		if !r.overlaps(t) {
 			continue
 		}
-		k, err := t.keyAt(0)
-		if err != nil {
+		it := t.newIterator(false)
+		if r.lower == "" {
+			it.first()
+		} else {
+			it.seek(r.lower)
+		}
+		if err := it.err(); err != nil {
 			return err
 		}
-		heap.Push(&it{t: t, i: 0, key: k})
+		if it.valid() {
+			heap.Push(it)
+		}
 	}
 
 	for heap.Size() > 0 {
 		v, _ := heap.Pop()
-		cur := v.(*it)
-		key := cur.key
-
-		offset, err := cur.t.offsetAt(cur.i)
-		if err != nil {
-			return err
-		}
-		first, err := cur.t.readRecordAt(offset)
-		if err != nil {
-			return err
-		}
-		if cur.i+1 < cur.t.keyCount {
-			k, err := cur.t.keyAt(cur.i + 1)
-			if err != nil {
-				return err
-			}
-			heap.Push(&it{t: cur.t, i: cur.i + 1, key: k})
+		cur := v.(internalIterator)
+		key := cur.key()
+		if r.upper != "" && key >= r.upper {
+			break
 		}
 
-		group := []VersionedValue{first}
-		for heap.Size() > 0 {
-			top, _ := heap.Peek()
-			if top.(*it).key != key {
-				break
-			}
-			v, _ := heap.Pop()
-			cur = v.(*it)
-			offset, err = cur.t.offsetAt(cur.i)
+		var group []VersionedValue
+		for {
+			val, err := cur.value()
 			if err != nil {
 				return err
 			}
-			val, err := cur.t.readRecordAt(offset)
-			if err != nil {
+			group = append(group, val)
+			cur.next()
+			if err := cur.err(); err != nil {
 				return err
 			}
-			group = append(group, val)
-			if cur.i+1 < cur.t.keyCount {
-				k, err := cur.t.keyAt(cur.i + 1)
-				if err != nil {
-					return err
-				}
-				heap.Push(&it{t: cur.t, i: cur.i + 1, key: k})
+			if cur.valid() {
+				heap.Push(cur)
 			}
+
+			top, ok := heap.Peek()
+			if !ok || top.(internalIterator).key() != key {
+				break
+			}
+			heap.Pop()
+			cur = top.(internalIterator)
 		}
 
-		merged, err := mergeVersionedRoaring(group)
+		if err := p.values.resolveMergeBases(group); err != nil {
+			return err
+		}
+		versions, err := collapseVersions(key, group, p.snapshots, p.op, p.bottom)
 		if err != nil {
 			return err
 		}
-		if err := emit(key, merged); err != nil {
+		if versions, err = p.filterVersions(key, versions); err != nil {
 			return err
 		}
+		for _, v := range versions {
+			if err := emit(key, v); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -0,0 +1,248 @@
+package lsm
+
+import "encoding/binary"
+
+const v1FooterSize = 12
+
+func (s *SSTable) loadV1(size uint64) error {
+	if size < v1FooterSize {
+		return errBadFooter
+	}
+
+	s.size = size
+	footer, err := s.readAt(v1FooterSize, size-v1FooterSize)
+	if err != nil {
+		return err
+	}
+	indexStart := binary.LittleEndian.Uint64(footer[0:8])
+	indexLen := binary.LittleEndian.Uint32(footer[8:12])
+
+	keyCount, bloom, err := s.readHeaderAt(0)
+	if err != nil {
+		return err
+	}
+
+	metaSize := uint64(keyCount)*8 + uint64(keyCount)*4
+	if uint64(indexLen) < metaSize {
+		return errBadFooter
+	}
+	keyEntriesLen := uint64(indexLen) - metaSize
+	offsetsStart := indexStart + keyEntriesLen
+	keyOffsetsStart := offsetsStart + uint64(keyCount)*8
+
+	s.version = sstFormatV1
+	s.keyCount = int(keyCount)
+	s.indexStart = indexStart
+	s.offsetsStart = offsetsStart
+	s.keyOffsetsStart = keyOffsetsStart
+	s.bloom = bloom
+
+	if s.keyCount > 0 {
+		minK, err := s.keyAt(0)
+		if err != nil {
+			return err
+		}
+		maxK, err := s.keyAt(s.keyCount - 1)
+		if err != nil {
+			return err
+		}
+		s.minKey = minK
+		s.maxKey = maxK
+	}
+	return nil
+}
+
+func (s *SSTable) getV1(key string) (v VersionedValue, found bool, err error) {
+	err = s.withFile(func() error {
+		idx, ok, err := s.findKeyIndex(key)
+		if err != nil || !ok {
+			return err
+		}
+		offset, err := s.offsetAt(idx)
+		if err != nil {
+			return err
+		}
+		v, err = s.readRecordAt(offset)
+		found = err == nil
+		return err
+	})
+	return v, found, err
+}
+
+func (s *SSTable) findKeyIndex(key string) (int, bool, error) {
+	l, err := s.lowerBound(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if l >= s.keyCount {
+		return 0, false, nil
+	}
+	k, err := s.keyAt(l)
+	if err != nil {
+		return 0, false, err
+	}
+	return l, k == key, nil
+}
+
+func (s *SSTable) lowerBound(key string) (int, error) {
+	l, r := 0, s.keyCount
+	for l < r {
+		mid := (l + r) / 2
+		mk, err := s.keyBytesAt(mid)
+		if err != nil {
+			return 0, err
+		}
+		if string(mk) < key {
+			l = mid + 1
+		} else {
+			r = mid
+		}
+	}
+	return l, nil
+}
+
+func (s *SSTable) keyAt(i int) (string, error) {
+	b, err := s.keyBytesAt(i)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (s *SSTable) keyBytesAt(i int) ([]byte, error) {
+	rel, err := s.keyOffsetAt(i)
+	if err != nil {
+		return nil, err
+	}
+	off := s.indexStart + uint64(rel)
+
+	n, err := s.readAt(4, off)
+	if err != nil {
+		return nil, err
+	}
+	return s.readAt(int(binary.LittleEndian.Uint32(n)), off+4)
+}
+
+func (s *SSTable) keyOffsetAt(i int) (uint32, error) {
+	b, err := s.readAt(4, s.keyOffsetsStart+uint64(i)*4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (s *SSTable) offsetAt(i int) (uint64, error) {
+	b, err := s.readAt(8, s.offsetsStart+uint64(i)*8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (s *SSTable) readRecordAt(offset uint64) (VersionedValue, error) {
+	hv, err := s.readAt(1, offset)
+	if err != nil {
+		return VersionedValue{}, err
+	}
+	pos := offset + 1
+
+	kind := valueKind(hv[0])
+	var valuePtr *string
+	if kind != kindDelete {
+		n, err := s.readAt(4, pos)
+		if err != nil {
+			return VersionedValue{}, err
+		}
+		pos += 4
+
+		valLen := int(binary.LittleEndian.Uint32(n))
+		valBytes, err := s.readAt(valLen, pos)
+		if err != nil {
+			return VersionedValue{}, err
+		}
+		pos += uint64(valLen)
+
+		valStr := string(valBytes)
+		valuePtr = &valStr
+	}
+
+	seq, err := s.readAt(4, pos)
+	if err != nil {
+		return VersionedValue{}, err
+	}
+	return VersionedValue{value: valuePtr, sequenceNumber: binary.LittleEndian.Uint32(seq), kind: kind}, nil
+}
+
+type v1Iterator struct {
+	t       *SSTable
+	reverse bool
+	i       int
+	k       string
+	lastErr error
+}
+
+func (s *v1Iterator) first() {
+	if s.reverse {
+		s.i = s.t.keyCount - 1
+	} else {
+		s.i = 0
+	}
+	s.load()
+}
+
+func (s *v1Iterator) seek(key string) {
+	var i int
+	err := s.t.withFile(func() (err error) {
+		i, err = s.t.lowerBound(key)
+		return err
+	})
+	if err != nil {
+		s.lastErr = err
+		return
+	}
+	s.i = i
+	s.load()
+	if s.reverse && (i == s.t.keyCount || s.k != key) {
+		s.i = i - 1
+		s.load()
+	}
+}
+
+func (s *v1Iterator) next() {
+	if s.reverse {
+		s.i--
+	} else {
+		s.i++
+	}
+	s.load()
+}
+
+func (s *v1Iterator) load() {
+	if s.i < 0 || s.i >= s.t.keyCount {
+		return
+	}
+	s.lastErr = s.t.withFile(func() (err error) {
+		s.k, err = s.t.keyAt(s.i)
+		return err
+	})
+}
+
+func (s *v1Iterator) valid() bool {
+	return s.lastErr == nil && s.i >= 0 && s.i < s.t.keyCount
+}
+
+func (s *v1Iterator) key() string { return s.k }
+
+func (s *v1Iterator) value() (v VersionedValue, err error) {
+	var offset uint64
+	err = s.t.withFile(func() (err error) {
+		if offset, err = s.t.offsetAt(s.i); err != nil {
+			return err
+		}
+		v, err = s.t.readRecordAt(offset)
+		return err
+	})
+	return v, s.t.corruption(offset, err)
+}
+
+func (s *v1Iterator) err() error { return s.t.corruption(0, s.lastErr) }
@@ -0,0 +1,259 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+type sstWriter struct {
+	path string
+	opts tableOptions
+	fs   FS
+	f    File
+	bw   *bufio.Writer
+	cw   *countingWriter
+
+	block         []byte
+	compressed    []byte
+	blockFirstKey string
+	restarts      []uint32
+	sinceRestart  int
+	blocks        []blockHandle
+	hashes        []uint64
+	lastKey       string
+	lastSeq       uint32
+	count         int
+	valueFiles    map[uint64]bool
+}
+
+func newSSTWriter(path string, opts tableOptions) (*sstWriter, error) {
+	if opts.blockSize <= 0 {
+		opts.blockSize = defaultBlockSize
+	}
+	fs := fileSystem(opts.fs)
+	if err := fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := fs.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(f)
+	return &sstWriter{
+		path: path,
+		opts: opts,
+		fs:   fs,
+		f:    f,
+		bw:   bw,
+		cw:   &countingWriter{w: bw},
+
+		valueFiles: make(map[uint64]bool),
+	}, nil
+}
+
+func (w *sstWriter) add(key string, v VersionedValue) error {
+	sameKey := w.count > 0 && key == w.lastKey
+	if (w.count > 0 && key < w.lastKey) || (sameKey && v.sequenceNumber >= w.lastSeq) {
+		return errors.New("sstable: entries must be added in key order, newest version first")
+	}
+	if w.opts.valueLog.separates(v) {
+		p, err := w.opts.valueLog.append(key, *v.value, w.valueFiles)
+		if err != nil {
+			return err
+		}
+		v.value, v.pointer = nil, &p
+	} else if v.pointer != nil && !w.valueFiles[v.pointer.fileID] {
+		w.valueFiles[v.pointer.fileID] = true
+		w.opts.valueLog.retain([]uint64{v.pointer.fileID})
+	}
+	if !sameKey && len(w.block) >= w.opts.blockSize {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	if len(w.block) == 0 {
+		w.blockFirstKey = key
+	}
+	shared := 0
+	if len(w.block) > 0 && w.sinceRestart < blockRestartInterval {
+		shared = sharedPrefixLen(w.lastKey, key)
+	} else {
+		w.restarts = append(w.restarts, uint32(len(w.block)))
+		w.sinceRestart = 0
+	}
+	w.sinceRestart++
+	w.block = appendBlockEntry(w.block, key, shared, v)
+	if !sameKey {
+		w.hashes = append(w.hashes, bloomHash(key))
+	}
+	w.lastKey = key
+	w.lastSeq = v.sequenceNumber
+	w.count++
+	return nil
+}
+
+func (w *sstWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.block = appendRestarts(w.block, w.restarts)
+	w.restarts = w.restarts[:0]
+	var err error
+	if w.compressed, err = compressBlock(w.compressed[:0], w.opts.compression, w.block); err != nil {
+		return err
+	}
+	w.compressed = appendChecksum(w.compressed)
+	h := blockHandle{firstKey: w.blockFirstKey, offset: w.cw.n, length: uint32(len(w.compressed))}
+	if _, err := w.cw.Write(w.compressed); err != nil {
+		return err
+	}
+	w.blocks = append(w.blocks, h)
+	w.block = w.block[:0]
+	return nil
+}
+
+func (w *sstWriter) size() uint64 {
+	return w.cw.n + uint64(len(w.block))
+}
+
+func (w *sstWriter) finish() (*SSTable, error) {
+	s, err := w.finishFile()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	w.releaseValueFiles()
+	return s, nil
+}
+
+func (w *sstWriter) finishFile() (*SSTable, error) {
+	if err := w.flushBlock(); err != nil {
+		return nil, err
+	}
+
+	bloom := NewBloomFilterWithBitsPerKey(len(w.hashes), w.opts.bloomBitsPerKey)
+	for _, h := range w.hashes {
+		bloom.addHash(h)
+	}
+	valueFiles := make([]uint64, 0, len(w.valueFiles))
+	for id := range w.valueFiles {
+		valueFiles = append(valueFiles, id)
+	}
+	sort.Slice(valueFiles, func(i, j int) bool { return valueFiles[i] < valueFiles[j] })
+	if len(valueFiles) > 0 {
+		if err := w.opts.valueLog.sync(); err != nil {
+			return nil, err
+		}
+	}
+	headerStart := w.cw.n
+	header := appendChecksum(appendValueFiles(headerBytes(uint32(w.count), bloom), valueFiles))
+	if _, err := w.cw.Write(header); err != nil {
+		return nil, err
+	}
+
+	indexStart := w.cw.n
+	index := appendChecksum(encodeIndexBlock(w.blocks, w.lastKey))
+	if _, err := w.cw.Write(index); err != nil {
+		return nil, err
+	}
+	if err := writeBlockFooter(w.cw, indexStart, uint32(len(index)), headerStart, uint32(len(header))); err != nil {
+		return nil, err
+	}
+	if err := w.bw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		return nil, err
+	}
+
+	s := newSSTable(w.path, w.f, w.opts)
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.fileOpened()
+	s.valueLog.retain(s.valueFiles)
+	return s, nil
+}
+
+func (w *sstWriter) abort() {
+	if w.f != nil {
+		_ = w.f.Close()
+		_ = w.fs.Remove(w.path)
+		w.f = nil
+	}
+	w.releaseValueFiles()
+}
+
+func (w *sstWriter) releaseValueFiles() {
+	ids := make([]uint64, 0, len(w.valueFiles))
+	for id := range w.valueFiles {
+		ids = append(ids, id)
+	}
+	clear(w.valueFiles)
+	w.opts.valueLog.release(ids)
+}
+
+func writeBlockFooter(w io.Writer, indexStart uint64, indexLen uint32, headerStart uint64, headerLen uint32) error {
+	ftr := make([]byte, 24, checksummedFooterSize)
+	binary.LittleEndian.PutUint64(ftr[0:8], indexStart)
+	binary.LittleEndian.PutUint32(ftr[8:12], indexLen)
+	binary.LittleEndian.PutUint64(ftr[12:20], headerStart)
+	binary.LittleEndian.PutUint32(ftr[20:24], headerLen)
+	ftr = appendChecksum(ftr)
+	ftr = binary.LittleEndian.AppendUint32(ftr, sstFormatValueLog)
+	ftr = binary.LittleEndian.AppendUint64(ftr, sstMagic)
+	_, err := w.Write(ftr)
+	return err
+}
+
+type SSTableWriter struct {
+	w *sstWriter
+}
+
+func NewSSTableWriter(path string, opts Options) (*SSTableWriter, error) {
+	w, err := newSSTWriter(path, tableOptions{
+		blockSize:       opts.BlockSize,
+		compression:     opts.Compression,
+		bloomBitsPerKey: opts.Bloom.bitsPerKey(),
+		fs:              opts.FS,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SSTableWriter{w: w}, nil
+}
+
+func (w *SSTableWriter) Put(key, value string) error {
+	return w.add(key, VersionedValue{value: &value, kind: kindPut})
+}
+
+func (w *SSTableWriter) Delete(key string) error {
+	return w.add(key, VersionedValue{kind: kindDelete})
+}
+
+func (w *SSTableWriter) Merge(key, operand string) error {
+	return w.add(key, VersionedValue{value: &operand, kind: kindMerge})
+}
+
+func (w *SSTableWriter) add(key string, v VersionedValue) error {
+	if w.w.count > 0 && key <= w.w.lastKey {
+		return errIngestKeyOrder
+	}
+	return w.w.add(key, v)
+}
+
+func (w *SSTableWriter) Finish() error {
+	t, err := w.w.finish()
+	if err != nil {
+		return err
+	}
+	return t.Close()
+}
+
+func (w *SSTableWriter) Abort() {
+	w.w.abort()
+}
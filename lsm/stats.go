@@ -0,0 +1,249 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var getLatencyBuckets = [...]time.Duration{
+	time.Microsecond,
+	4 * time.Microsecond,
+	16 * time.Microsecond,
+	64 * time.Microsecond,
+	256 * time.Microsecond,
+	time.Millisecond,
+	4 * time.Millisecond,
+	16 * time.Millisecond,
+	64 * time.Millisecond,
+	256 * time.Millisecond,
+	time.Second,
+}
+
+type Stats struct {
+	Levels             []LevelStats
+	MemTableBytes      int64
+	MemTableEntries    int
+	ImmutableMemTables int
+	ImmutableBytes     int64
+	OpenTables         int
+	Flushes            OperationStats
+	Compactions        OperationStats
+	Gets               GetStats
+	Bloom              BloomStats
+}
+
+type LevelStats struct {
+	Level int
+	Files int
+	Bytes uint64
+}
+
+type OperationStats struct {
+	Count        uint64
+	Duration     time.Duration
+	BytesWritten uint64
+}
+
+type GetStats struct {
+	Count        uint64
+	TablesProbed uint64
+	Latency      Histogram
+}
+
+func (g GetStats) ReadAmplification() float64 {
+	if g.Count == 0 {
+		return 0
+	}
+	return float64(g.TablesProbed) / float64(g.Count)
+}
+
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Sum    time.Duration
+}
+
+func (h Histogram) Count() uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+type operationCounters struct {
+	count        atomic.Uint64
+	nanos        atomic.Int64
+	bytesWritten atomic.Uint64
+}
+
+func (c *operationCounters) record(d time.Duration, bytes uint64) {
+	c.count.Add(1)
+	c.nanos.Add(int64(d))
+	c.bytesWritten.Add(bytes)
+}
+
+func (c *operationCounters) stats() OperationStats {
+	return OperationStats{
+		Count:        c.count.Load(),
+		Duration:     time.Duration(c.nanos.Load()),
+		BytesWritten: c.bytesWritten.Load(),
+	}
+}
+
+type histogram struct {
+	counts [len(getLatencyBuckets) + 1]atomic.Uint64
+	nanos  atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(getLatencyBuckets) && d > getLatencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.nanos.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	out := Histogram{
+		Bounds: append([]time.Duration(nil), getLatencyBuckets[:]...),
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    time.Duration(h.nanos.Load()),
+	}
+	for i := range h.counts {
+		out.Counts[i] = h.counts[i].Load()
+	}
+	return out
+}
+
+type metrics struct {
+	flushes      operationCounters
+	compactions  operationCounters
+	gets         atomic.Uint64
+	tablesProbed atomic.Uint64
+	getLatency   histogram
+}
+
+func (m *metrics) recordGet(start time.Time, probed int) {
+	m.gets.Add(1)
+	m.tablesProbed.Add(uint64(probed))
+	m.getLatency.observe(time.Since(start))
+}
+
+func (l *LSM) Stats() Stats {
+	l.mutex.RLock()
+	s := Stats{
+		MemTableBytes:      l.memTable.Size(),
+		MemTableEntries:    l.memTable.Len(),
+		ImmutableMemTables: len(l.immutables),
+	}
+	for _, imm := range l.immutables {
+		s.ImmutableBytes += imm.table.Size()
+	}
+	for level, tables := range l.files {
+		ls := LevelStats{Level: level, Files: len(tables)}
+		for _, t := range tables {
+			ls.Bytes += t.size
+		}
+		s.Levels = append(s.Levels, ls)
+	}
+	l.mutex.RUnlock()
+
+	s.Flushes = l.metrics.flushes.stats()
+	s.Compactions = l.metrics.compactions.stats()
+	s.Gets = GetStats{
+		Count:        l.metrics.gets.Load(),
+		TablesProbed: l.metrics.tablesProbed.Load(),
+		Latency:      l.metrics.getLatency.snapshot(),
+	}
+	s.Bloom = l.BloomStats()
+	if l.tableOpts.tableCache != nil {
+		s.OpenTables = l.tableOpts.tableCache.Len()
+	}
+	return s
+}
+
+func (s Stats) WritePrometheus(w io.Writer) error {
+	p := &promWriter{w: w}
+	p.header("lsm_level_files", "gauge", "Number of SSTables in each level.")
+	for _, ls := range s.Levels {
+		p.sample("lsm_level_files", fmt.Sprintf(`{level="%d"}`, ls.Level), float64(ls.Files))
+	}
+	p.header("lsm_level_bytes", "gauge", "Bytes of SSTables in each level.")
+	for _, ls := range s.Levels {
+		p.sample("lsm_level_bytes", fmt.Sprintf(`{level="%d"}`, ls.Level), float64(ls.Bytes))
+	}
+	p.gauge("lsm_memtable_bytes", "Key and value bytes in the active memtable.", float64(s.MemTableBytes))
+	p.gauge("lsm_memtable_entries", "Versions in the active memtable.", float64(s.MemTableEntries))
+	p.gauge("lsm_immutable_memtables", "Memtables waiting to be flushed.", float64(s.ImmutableMemTables))
+	p.gauge("lsm_immutable_memtable_bytes", "Key and value bytes in memtables waiting to be flushed.", float64(s.ImmutableBytes))
+	p.gauge("lsm_open_tables", "SSTables holding an open file.", float64(s.OpenTables))
+	p.operation("lsm_flush", "flushes", s.Flushes)
+	p.operation("lsm_compaction", "compactions", s.Compactions)
+
+	p.header("lsm_get_latency_seconds", "histogram", "Latency of point lookups.")
+	var cumulative uint64
+	for i, c := range s.Gets.Latency.Counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(s.Gets.Latency.Bounds) {
+			le = fmt.Sprint(s.Gets.Latency.Bounds[i].Seconds())
+		}
+		p.sample("lsm_get_latency_seconds_bucket", fmt.Sprintf(`{le="%s"}`, le), float64(cumulative))
+	}
+	p.sample("lsm_get_latency_seconds_sum", "", s.Gets.Latency.Sum.Seconds())
+	p.sample("lsm_get_latency_seconds_count", "", float64(cumulative))
+	p.counter("lsm_get_tables_probed_total", "SSTables probed by point lookups.", float64(s.Gets.TablesProbed))
+
+	p.counter("lsm_bloom_checks_total", "Bloom filter checks.", float64(s.Bloom.Checks))
+	p.counter("lsm_bloom_negatives_total", "Bloom filter checks that skipped a table read.", float64(s.Bloom.Negatives))
+	p.counter("lsm_bloom_false_positives_total", "Bloom filter checks that passed for an absent key.", float64(s.Bloom.FalsePositives))
+	return p.err
+}
+
+func (l *LSM) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = l.Stats().WritePrometheus(w)
+	})
+}
+
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, v float64) {
+	p.printf("%s%s %v\n", name, labels, v)
+}
+
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, "", v)
+}
+
+func (p *promWriter) counter(name, help string, v float64) {
+	p.header(name, "counter", help)
+	p.sample(name, "", v)
+}
+
+func (p *promWriter) operation(prefix, noun string, s OperationStats) {
+	p.counter("lsm_"+noun+"_total", "Completed "+noun+".", float64(s.Count))
+	p.counter(prefix+"_seconds_total", "Time spent in "+noun+".", s.Duration.Seconds())
+	p.counter(prefix+"_bytes_written_total", "Bytes written by "+noun+".", float64(s.BytesWritten))
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, format, args...)
+}
@@ -0,0 +1,98 @@
+package lsm
+
+import (
+	"sort"
+	"sync"
+)
+
+type mergeBounds struct {
+	lower string
+	upper string
+}
+
+func (r mergeBounds) overlaps(t *SSTable) bool {
+	if t.keyCount == 0 {
+		return false
+	}
+	return (r.upper == "" || t.minKey < r.upper) && t.maxKey >= r.lower
+}
+
+func compactSSTables(newPath func() string, opts tableOptions, p mergePolicy, targetFileSize uint64, subcompactions int, tables ...*SSTable) ([]*SSTable, error) {
+	var total uint64
+	for _, t := range tables {
+		total += t.size
+	}
+	if targetFileSize > 0 {
+		subcompactions = min(subcompactions, int(total/targetFileSize))
+	}
+	ranges := subcompactionRanges(tables, subcompactions)
+	if len(ranges) == 1 {
+		return compactRange(newPath, opts, p, targetFileSize, ranges[0], tables...)
+	}
+
+	outputs := make([][]*SSTable, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs[i], errs[i] = compactRange(newPath, opts, p, targetFileSize, r, tables...)
+		}()
+	}
+	wg.Wait()
+
+	var out []*SSTable
+	for _, tables := range outputs {
+		out = append(out, tables...)
+	}
+	for _, err := range errs {
+		if err != nil {
+			for _, t := range out {
+				_ = t.Close()
+				_ = t.fs.Remove(t.Path())
+			}
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func subcompactionRanges(tables []*SSTable, n int) []mergeBounds {
+	if n <= 1 {
+		return []mergeBounds{{}}
+	}
+	var keys []string
+	for _, t := range tables {
+		if t.keyCount == 0 {
+			continue
+		}
+		if len(t.blocks) == 0 {
+			keys = append(keys, t.minKey)
+			continue
+		}
+		for _, h := range t.blocks {
+			keys = append(keys, h.firstKey)
+		}
+	}
+	sort.Strings(keys)
+	distinct := keys[:0]
+	for i, k := range keys {
+		if i == 0 || k != keys[i-1] {
+			distinct = append(distinct, k)
+		}
+	}
+	n = min(n, len(distinct))
+	if n <= 1 {
+		return []mergeBounds{{}}
+	}
+
+	ranges := make([]mergeBounds, 0, n)
+	lower := ""
+	for i := 1; i < n; i++ {
+		upper := distinct[i*len(distinct)/n]
+		ranges = append(ranges, mergeBounds{lower: lower, upper: upper})
+		lower = upper
+	}
+	return append(ranges, mergeBounds{lower: lower})
+}
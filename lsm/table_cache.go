@@ -0,0 +1,50 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+type TableCache struct {
+	mutex    sync.Mutex
+	capacity int
+	lru      *list.List
+}
+
+func NewTableCache(maxOpenTables int) *TableCache {
+	return &TableCache{capacity: max(maxOpenTables, 1), lru: list.New()}
+}
+
+func (c *TableCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+func (c *TableCache) touch(t *SSTable) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if t.tableCacheElem != nil {
+		c.lru.MoveToFront(t.tableCacheElem)
+	} else {
+		t.tableCacheElem = c.lru.PushFront(t)
+	}
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.capacity; {
+		prev := e.Prev()
+		victim := e.Value.(*SSTable)
+		if victim != t && victim.closeIdleFile() {
+			c.lru.Remove(e)
+			victim.tableCacheElem = nil
+		}
+		e = prev
+	}
+}
+
+func (c *TableCache) remove(t *SSTable) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if t.tableCacheElem != nil {
+		c.lru.Remove(t.tableCacheElem)
+		t.tableCacheElem = nil
+	}
+}
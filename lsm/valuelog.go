@@ -0,0 +1,508 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errBadValueLogEntry    = errors.New("vlog: malformed entry")
+	errValueLogUnavailable = errors.New("vlog: value stored in a value log that is not open")
+)
+
+type valuePointer struct {
+	fileID uint64
+	offset uint64
+	length uint32
+}
+
+type valueLog struct {
+	fs        FS
+	dir       string
+	threshold int
+	fileSize  int64
+	nextID    func() uint64
+
+	mu       sync.Mutex
+	head     File
+	headID   uint64
+	headSize int64
+	dirty    bool
+	readers  map[uint64]File
+	refs     map[uint64]int
+	closed   bool
+}
+
+func newValueLog(fs FS, dir string, threshold int, fileSize int64, nextID func() uint64) *valueLog {
+	return &valueLog{
+		fs:        fs,
+		dir:       dir,
+		threshold: threshold,
+		fileSize:  fileSize,
+		nextID:    nextID,
+		readers:   make(map[uint64]File),
+		refs:      make(map[uint64]int),
+	}
+}
+
+func valueLogName(id uint64) string {
+	return fmt.Sprintf("vlog-%d.log", id)
+}
+
+func parseValueLogName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "vlog-") || !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+	var id uint64
+	if _, err := fmt.Sscanf(name, "vlog-%d.log", &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+func (vl *valueLog) separates(v VersionedValue) bool {
+	return vl != nil && vl.threshold > 0 && v.kind == kindPut && v.pointer == nil && len(*v.value) >= vl.threshold
+}
+
+func (vl *valueLog) append(key, value string, pinned map[uint64]bool) (valuePointer, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if vl.head != nil && vl.headSize >= vl.fileSize {
+		if err := vl.sealLocked(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+	if vl.head == nil {
+		id := vl.nextID()
+		f, err := vl.fs.Create(filepath.Join(vl.dir, valueLogName(id)))
+		if err != nil {
+			return valuePointer{}, err
+		}
+		vl.head, vl.headID, vl.headSize = f, id, 0
+		vl.readers[id] = f
+	}
+
+	b := binary.AppendUvarint(nil, uint64(len(key)))
+	b = append(b, key...)
+	b = appendChecksum(append(b, value...))
+	if _, err := vl.head.Write(b); err != nil {
+		return valuePointer{}, err
+	}
+	p := valuePointer{fileID: vl.headID, offset: uint64(vl.headSize), length: uint32(len(b))}
+	vl.headSize += int64(len(b))
+	vl.dirty = true
+	if !pinned[p.fileID] {
+		pinned[p.fileID] = true
+		vl.refs[p.fileID]++
+	}
+	return p, nil
+}
+
+func (vl *valueLog) sync() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if vl.head == nil || !vl.dirty {
+		return nil
+	}
+	vl.dirty = false
+	return vl.head.Sync()
+}
+
+func (vl *valueLog) seal() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	return vl.sealLocked()
+}
+
+func (vl *valueLog) sealLocked() error {
+	if vl.head == nil {
+		return nil
+	}
+	err := vl.head.Sync()
+	vl.head, vl.dirty = nil, false
+	return err
+}
+
+func (vl *valueLog) read(p valuePointer) (string, error) {
+	if vl == nil {
+		return "", errValueLogUnavailable
+	}
+	vl.mu.Lock()
+	f, ok := vl.readers[p.fileID]
+	if !ok {
+		var err error
+		if f, err = vl.fs.Open(filepath.Join(vl.dir, valueLogName(p.fileID))); err != nil {
+			vl.mu.Unlock()
+			return "", err
+		}
+		vl.readers[p.fileID] = f
+	}
+	vl.mu.Unlock()
+	return readValueAt(f, filepath.Join(vl.dir, valueLogName(p.fileID)), p)
+}
+
+func readValueAt(f File, path string, p valuePointer) (string, error) {
+	b := make([]byte, p.length)
+	if _, err := f.ReadAt(b, int64(p.offset)); err != nil {
+		return "", &CorruptionError{Path: path, Offset: p.offset, Err: err}
+	}
+	payload, err := verifyChecksum(b)
+	if err != nil {
+		return "", &CorruptionError{Path: path, Offset: p.offset, Err: err}
+	}
+	n, sz := binary.Uvarint(payload)
+	if sz <= 0 || uint64(len(payload)-sz) < n {
+		return "", &CorruptionError{Path: path, Offset: p.offset, Err: errBadValueLogEntry}
+	}
+	return string(payload[sz+int(n):]), nil
+}
+
+func (vl *valueLog) load(v *VersionedValue) error {
+	if v.pointer == nil {
+		return nil
+	}
+	value, err := vl.read(*v.pointer)
+	if err != nil {
+		return err
+	}
+	v.value = &value
+	v.pointer = nil
+	return nil
+}
+
+func (vl *valueLog) resolveNewest(versions []VersionedValue) error {
+	sortVersions(versions)
+	for i := range versions {
+		if versions[i].kind != kindMerge {
+			return vl.load(&versions[i])
+		}
+	}
+	return nil
+}
+
+func (vl *valueLog) resolveMergeBases(versions []VersionedValue) error {
+	sortVersions(versions)
+	for i := 1; i < len(versions); i++ {
+		if versions[i-1].kind == kindMerge {
+			if err := vl.load(&versions[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sortVersions(versions []VersionedValue) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].sequenceNumber > versions[j].sequenceNumber
+	})
+}
+
+func (vl *valueLog) retain(ids []uint64) {
+	if vl == nil || len(ids) == 0 {
+		return
+	}
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	for _, id := range ids {
+		vl.refs[id]++
+	}
+}
+
+func (vl *valueLog) release(ids []uint64) {
+	if vl == nil || len(ids) == 0 {
+		return
+	}
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	for _, id := range ids {
+		vl.refs[id]--
+		if vl.refs[id] <= 0 {
+			delete(vl.refs, id)
+			if !vl.closed && (vl.head == nil || id != vl.headID) {
+				vl.removeLocked(id)
+			}
+		}
+	}
+}
+
+func (vl *valueLog) removeLocked(id uint64) {
+	if f, ok := vl.readers[id]; ok {
+		_ = f.Close()
+		delete(vl.readers, id)
+	}
+	_ = vl.fs.Remove(filepath.Join(vl.dir, valueLogName(id)))
+}
+
+func (vl *valueLog) removeUnreferenced() error {
+	entries, err := vl.fs.ReadDir(vl.dir)
+	if err != nil {
+		return err
+	}
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	var errs []error
+	for _, e := range entries {
+		id, ok := parseValueLogName(e.Name())
+		if !ok || vl.refs[id] > 0 || (vl.head != nil && id == vl.headID) {
+			continue
+		}
+		if err := vl.fs.Remove(filepath.Join(vl.dir, e.Name())); err != nil {
+			errs = append(errs, fmt.Errorf("remove %s: %w", e.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (vl *valueLog) files() []uint64 {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	ids := make([]uint64, 0, len(vl.refs))
+	for id := range vl.refs {
+		if vl.head == nil || id != vl.headID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (vl *valueLog) close() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	vl.closed = true
+	var errs []error
+	if vl.head != nil {
+		errs = append(errs, vl.head.Sync())
+		vl.head = nil
+	}
+	for id, f := range vl.readers {
+		errs = append(errs, f.Close())
+		delete(vl.readers, id)
+	}
+	return errors.Join(errs...)
+}
+
+type ValueLogGCResult struct {
+	FilesCollected  int
+	TablesRewritten int
+	BytesRelocated  uint64
+	BytesReclaimed  uint64
+}
+
+type valueRewrite struct {
+	level int
+	in    *SSTable
+	out   *SSTable
+}
+
+func (l *LSM) CollectValueLog(minGarbageRatio float64) (ValueLogGCResult, error) {
+	var res ValueLogGCResult
+	if err := l.values.seal(); err != nil {
+		return res, err
+	}
+	tables, err := l.pinTables()
+	if err != nil {
+		return res, err
+	}
+	selected, sizes, err := l.values.pickGarbage(tables, minGarbageRatio)
+	for _, t := range tables {
+		t.release()
+	}
+	if err != nil || len(selected) == 0 {
+		return res, err
+	}
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return res, ErrClosed
+	}
+	var rewrites []*valueRewrite
+	for level, ts := range l.files {
+		for _, t := range ts {
+			if !t.compacting && t.pointsInto(selected) {
+				t.compacting = true
+				rewrites = append(rewrites, &valueRewrite{level: level, in: t})
+			}
+		}
+	}
+	l.runningCompactions++
+	l.mutex.Unlock()
+
+	for _, r := range rewrites {
+		var relocated uint64
+		if r.out, relocated, err = l.relocateValues(r.level, r.in, selected); err != nil {
+			break
+		}
+		res.BytesRelocated += relocated
+	}
+	if err == nil {
+		err = l.fs.SyncDir(l.dir)
+	}
+
+	l.mutex.Lock()
+	l.runningCompactions--
+	for _, r := range rewrites {
+		r.in.compacting = false
+	}
+	if err == nil && l.closed {
+		err = ErrClosed
+	}
+	if err == nil {
+		err = l.installRewritesLocked(rewrites)
+	} else {
+		for _, r := range rewrites {
+			if r.out != nil {
+				r.out.obsolete.Store(true)
+				r.out.release()
+			}
+		}
+	}
+	l.cond.Broadcast()
+	l.mutex.Unlock()
+	if err != nil {
+		return res, err
+	}
+
+	res.TablesRewritten = len(rewrites)
+	for id := range selected {
+		if _, err := l.fs.Stat(filepath.Join(l.dir, valueLogName(id))); os.IsNotExist(err) {
+			res.FilesCollected++
+			res.BytesReclaimed += sizes[id]
+		}
+	}
+	return res, nil
+}
+
+func (l *LSM) pinTables() ([]*SSTable, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	var tables []*SSTable
+	for _, level := range l.files {
+		for _, t := range level {
+			t.acquire()
+			tables = append(tables, t)
+		}
+	}
+	return tables, nil
+}
+
+func (vl *valueLog) pickGarbage(tables []*SSTable, minGarbageRatio float64) (map[uint64]bool, map[uint64]uint64, error) {
+	sizes := make(map[uint64]uint64)
+	candidates := make(map[uint64]bool)
+	for _, id := range vl.files() {
+		st, err := vl.fs.Stat(filepath.Join(vl.dir, valueLogName(id)))
+		if err != nil {
+			return nil, nil, err
+		}
+		sizes[id] = uint64(st.Size())
+		candidates[id] = true
+	}
+
+	live := make(map[uint64]uint64)
+	for _, t := range tables {
+		if !t.pointsInto(candidates) {
+			continue
+		}
+		it := t.newIterator(false)
+		for it.first(); it.valid(); it.next() {
+			v, err := it.value()
+			if err != nil {
+				return nil, nil, err
+			}
+			if v.pointer != nil {
+				live[v.pointer.fileID] += uint64(v.pointer.length)
+			}
+		}
+		if err := it.err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	selected := make(map[uint64]bool)
+	for id, size := range sizes {
+		if size > 0 && 1-float64(live[id])/float64(size) >= minGarbageRatio {
+			selected[id] = true
+		}
+	}
+	return selected, sizes, nil
+}
+
+func (s *SSTable) pointsInto(ids map[uint64]bool) bool {
+	for _, id := range s.valueFiles {
+		if ids[id] {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *LSM) relocateValues(level int, t *SSTable, selected map[uint64]bool) (*SSTable, uint64, error) {
+	l.mutex.Lock()
+	path := l.newFilePathLocked(level)
+	l.mutex.Unlock()
+
+	w, err := newSSTWriter(path, l.tableOptsForLevel(level))
+	if err != nil {
+		return nil, 0, err
+	}
+	var relocated uint64
+	it := t.newIterator(false)
+	for it.first(); it.valid(); it.next() {
+		v, err := it.value()
+		if err == nil && v.pointer != nil && selected[v.pointer.fileID] {
+			relocated += uint64(v.pointer.length)
+			err = l.values.load(&v)
+		}
+		if err == nil {
+			err = w.add(it.key(), v)
+		}
+		if err != nil {
+			w.abort()
+			return nil, 0, err
+		}
+	}
+	if err := it.err(); err != nil {
+		w.abort()
+		return nil, 0, err
+	}
+	out, err := w.finish()
+	return out, relocated, err
+}
+
+func (l *LSM) installRewritesLocked(rewrites []*valueRewrite) error {
+	var edit versionEdit
+	for _, r := range rewrites {
+		added := r.out.manifestTable(r.level)
+		added.replaces = filepath.Base(r.in.Path())
+		edit.added = append(edit.added, added)
+		edit.deleted = append(edit.deleted, added.replaces)
+	}
+	if err := l.logEditLocked(edit); err != nil {
+		for _, r := range rewrites {
+			r.out.obsolete.Store(true)
+			r.out.release()
+		}
+		return err
+	}
+	for _, r := range rewrites {
+		for i, t := range l.files[r.level] {
+			if t == r.in {
+				l.files[r.level][i] = r.out
+			}
+		}
+		r.in.obsolete.Store(true)
+		r.in.release()
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	SyncEveryWrite SyncPolicy = iota
+	// SyncGrouped syncs the WAL at most once per SyncInterval. A background
+	// timer syncs whatever is still pending, so an acknowledged write is on
+	// stable storage no later than SyncInterval after it returned.
+	SyncGrouped
+	SyncNever
+)
+
+const walBatchMarker = ^uint32(0)
+
+var errShortWALEntry = errors.New("wal: short entry")
+
+type wal struct {
+	fs          FS
+	dir         string
+	policy      SyncPolicy
+	interval    time.Duration
+	onSyncError func(error)
+
+	mutex    sync.Mutex
+	f        File
+	id       uint64
+	sealed   []uint64
+	lastSync time.Time
+	pending  bool
+	timer    *time.Timer
+}
+
+func walPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wal-%d.log", id))
+}
+
+func listWALSegments(fs FS, dir string) ([]uint64, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "wal-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func openWAL(fs FS, dir string, policy SyncPolicy, interval time.Duration, flushed uint64, replay func(key string, v VersionedValue) error) (*wal, error) {
+	all, err := listWALSegments(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, id := range all {
+		if id <= flushed {
+			if err := fs.Remove(walPath(dir, id)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		if err := replayWALSegment(fs, walPath(dir, id), replay); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	next := flushed + 1
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	w := &wal{
+		fs:       fs,
+		dir:      dir,
+		policy:   policy,
+		interval: interval,
+		sealed:   ids,
+	}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func replayWALSegment(fs FS, path string, fn func(key string, v VersionedValue) error) error {
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readLogRecords(f, func(payload []byte) error {
+		entries, err := decodeWALRecord(payload)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(e.key, e.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (w *wal) openSegment(id uint64) error {
+	f, err := w.fs.Create(walPath(w.dir, id))
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.id = id
+	w.lastSync = time.Now()
+	w.pending = false
+	return nil
+}
+
+func (w *wal) append(entries []batchEntry) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := appendLogRecord(w.f, encodeWALBatch(entries)); err != nil {
+		return err
+	}
+	switch w.policy {
+	case SyncEveryWrite:
+		return w.f.Sync()
+	case SyncGrouped:
+		if wait := w.interval - time.Since(w.lastSync); wait > 0 {
+			w.pending = true
+			if w.timer == nil {
+				w.timer = time.AfterFunc(wait, w.syncPending)
+			}
+			return nil
+		}
+		return w.syncLocked()
+	}
+	return nil
+}
+
+func (w *wal) syncLocked() error {
+	w.lastSync = time.Now()
+	w.pending = false
+	return w.f.Sync()
+}
+
+func (w *wal) syncPending() {
+	w.mutex.Lock()
+	w.timer = nil
+	var err error
+	if w.f != nil && w.pending {
+		err = w.syncLocked()
+	}
+	w.mutex.Unlock()
+	if err != nil && w.onSyncError != nil {
+		w.onSyncError(err)
+	}
+}
+
+func (w *wal) abandonSegment() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	w.sealed = append(w.sealed, w.id)
+	if oerr := w.openSegment(w.id + 1); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (w *wal) rotate() ([]uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := w.f.Close(); err != nil {
+		return nil, err
+	}
+	sealed := append(w.sealed, w.id)
+	w.sealed = nil
+	if err := w.openSegment(w.id + 1); err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+func (w *wal) remove(ids []uint64) error {
+	var errs []error
+	for _, id := range ids {
+		if err := w.fs.Remove(walPath(w.dir, id)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *wal) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+func encodeWALEntry(key string, v VersionedValue) []byte {
+	var buf bytes.Buffer
+	var u32 [4]byte
+	binary.LittleEndian.PutUint32(u32[:], uint32(len(key)))
+	buf.Write(u32[:])
+	buf.WriteString(key)
+	_, _ = writeRecord(&buf, v)
+	return buf.Bytes()
+}
+
+func encodeWALBatch(entries []batchEntry) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, walBatchMarker)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(entries)))
+	for _, e := range entries {
+		entry := encodeWALEntry(e.key, e.value)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(entry)))
+		b = append(b, entry...)
+	}
+	return b
+}
+
+func decodeWALRecord(payload []byte) ([]batchEntry, error) {
+	if len(payload) < 8 || binary.LittleEndian.Uint32(payload[0:4]) != walBatchMarker {
+		key, v, err := decodeWALEntry(payload)
+		if err != nil {
+			return nil, err
+		}
+		return []batchEntry{{key: key, value: v}}, nil
+	}
+	count := binary.LittleEndian.Uint32(payload[4:8])
+	pos := 8
+	entries := make([]batchEntry, 0, min(int(count), len(payload)/4))
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < pos+4 {
+			return nil, errShortWALEntry
+		}
+		n := int(binary.LittleEndian.Uint32(payload[pos : pos+4]))
+		pos += 4
+		if len(payload) < pos+n {
+			return nil, errShortWALEntry
+		}
+		key, v, err := decodeWALEntry(payload[pos : pos+n])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batchEntry{key: key, value: v})
+		pos += n
+	}
+	return entries, nil
+}
+
+func decodeWALEntry(payload []byte) (string, VersionedValue, error) {
+	if len(payload) < 4 {
+		return "", VersionedValue{}, errShortWALEntry
+	}
+	keyLen := int(binary.LittleEndian.Uint32(payload[0:4]))
+	pos := 4
+	if len(payload) < pos+keyLen+1 {
+		return "", VersionedValue{}, errShortWALEntry
+	}
+	key := string(payload[pos : pos+keyLen])
+	pos += keyLen
+
+	v, _, err := decodeRecord(payload[pos:], true)
+	if err != nil {
+		return "", VersionedValue{}, errShortWALEntry
+	}
+	return key, v, nil
+}